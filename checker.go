@@ -0,0 +1,227 @@
+package texst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckerFactory creates a SegChecker from the arguments of a checker
+// argument line, e.g. "1..100" from " !m int 1..100".
+type CheckerFactory func(args string) (SegChecker, error)
+
+var (
+	checkersLock sync.RWMutex
+	checkers     = map[string]CheckerFactory{
+		"int":      newIntChecker,
+		"float":    newFloatChecker,
+		"uuid":     newUUIDChecker,
+		"hex":      newHexChecker,
+		"time":     newTimeChecker,
+		"ip":       newIPChecker,
+		"duration": newDurationChecker,
+	}
+)
+
+// RegisterChecker makes the checker factory available by name for checker
+// argument lines. It panics if name is already registered or if f is nil.
+func RegisterChecker(name string, f CheckerFactory) {
+	checkersLock.Lock()
+	defer checkersLock.Unlock()
+	if f == nil {
+		panic("texst: register nil checker " + name)
+	}
+	if _, dup := checkers[name]; dup {
+		panic("texst: register checker twice: " + name)
+	}
+	checkers[name] = f
+}
+
+// Checkers returns the sorted names of all registered checkers.
+func Checkers() []string {
+	checkersLock.RLock()
+	defer checkersLock.RUnlock()
+	names := make([]string, 0, len(checkers))
+	for n := range checkers {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewChecker creates the SegChecker registered with name.
+func NewChecker(name, args string) (SegChecker, error) {
+	checkersLock.RLock()
+	f := checkers[name]
+	checkersLock.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("unknown checker '%s'", name)
+	}
+	return f(args)
+}
+
+// CheckFunc adapts a function to the SegChecker interface.
+type CheckFunc func(seg []byte) error
+
+func (f CheckFunc) Check(seg []byte) error { return f(seg) }
+
+// parseBounds parses "lo..hi" where either bound can be omitted. An empty
+// string has no bounds.
+func parseBounds[T any](s string, parse func(string) (T, error)) (lo, hi *T, err error) {
+	if s == "" {
+		return nil, nil, nil
+	}
+	ls, hs, ok := strings.Cut(s, "..")
+	if !ok {
+		return nil, nil, fmt.Errorf("illegal range '%s'", s)
+	}
+	if ls != "" {
+		v, err := parse(ls)
+		if err != nil {
+			return nil, nil, err
+		}
+		lo = &v
+	}
+	if hs != "" {
+		v, err := parse(hs)
+		if err != nil {
+			return nil, nil, err
+		}
+		hi = &v
+	}
+	return lo, hi, nil
+}
+
+type number interface {
+	int64 | float64 | time.Duration
+}
+
+func checkBounds[T number](v T, lo, hi *T, str func(T) string) error {
+	if lo != nil && v < *lo {
+		return fmt.Errorf("%s less than %s", str(v), str(*lo))
+	}
+	if hi != nil && v > *hi {
+		return fmt.Errorf("%s greater than %s", str(v), str(*hi))
+	}
+	return nil
+}
+
+func newIntChecker(args string) (SegChecker, error) {
+	parse := func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) }
+	lo, hi, err := parseBounds(args, parse)
+	if err != nil {
+		return nil, fmt.Errorf("int checker: %w", err)
+	}
+	str := func(i int64) string { return strconv.FormatInt(i, 10) }
+	return CheckFunc(func(seg []byte) error {
+		i, err := parse(string(seg))
+		if err != nil {
+			return fmt.Errorf("not an integer: %s", seg)
+		}
+		return checkBounds(i, lo, hi, str)
+	}), nil
+}
+
+func newFloatChecker(args string) (SegChecker, error) {
+	parse := func(s string) (float64, error) { return strconv.ParseFloat(s, 64) }
+	lo, hi, err := parseBounds(args, parse)
+	if err != nil {
+		return nil, fmt.Errorf("float checker: %w", err)
+	}
+	str := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	return CheckFunc(func(seg []byte) error {
+		f, err := parse(string(seg))
+		if err != nil {
+			return fmt.Errorf("not a float: %s", seg)
+		}
+		return checkBounds(f, lo, hi, str)
+	}), nil
+}
+
+func newDurationChecker(args string) (SegChecker, error) {
+	lo, hi, err := parseBounds(args, time.ParseDuration)
+	if err != nil {
+		return nil, fmt.Errorf("duration checker: %w", err)
+	}
+	return CheckFunc(func(seg []byte) error {
+		d, err := time.ParseDuration(string(seg))
+		if err != nil {
+			return fmt.Errorf("not a duration: %s", seg)
+		}
+		return checkBounds(d, lo, hi, time.Duration.String)
+	}), nil
+}
+
+var uuidRegexp = regexp.MustCompile(`^[[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}$`)
+
+func newUUIDChecker(args string) (SegChecker, error) {
+	if args != "" {
+		return nil, errors.New("uuid checker has no arguments")
+	}
+	return CheckFunc(func(seg []byte) error {
+		if !uuidRegexp.Match(seg) {
+			return fmt.Errorf("not a UUID: %s", seg)
+		}
+		return nil
+	}), nil
+}
+
+func newHexChecker(args string) (SegChecker, error) {
+	if args != "" {
+		return nil, errors.New("hex checker has no arguments")
+	}
+	return CheckFunc(func(seg []byte) error {
+		if len(seg) == 0 || bytes.IndexFunc(seg, func(r rune) bool {
+			return !strings.ContainsRune("0123456789abcdefABCDEF", r)
+		}) >= 0 {
+			return fmt.Errorf("not hexadecimal: %s", seg)
+		}
+		return nil
+	}), nil
+}
+
+// newTimeChecker checks time values with the Go time layout args, the default
+// layout is time.RFC3339. Args can also name a layout constant of package
+// time, e.g. "StampMilli".
+func newTimeChecker(args string) (SegChecker, error) {
+	layout := timeLayout(args)
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return CheckFunc(func(seg []byte) error {
+		if _, err := time.Parse(layout, string(seg)); err != nil {
+			return fmt.Errorf("not a time '%s': %s", layout, seg)
+		}
+		return nil
+	}), nil
+}
+
+// newIPChecker checks IP addresses, args can be "v4" or "v6" to restrict the
+// IP version.
+func newIPChecker(args string) (SegChecker, error) {
+	var is func(netip.Addr) bool
+	switch args {
+	case "":
+		is = func(netip.Addr) bool { return true }
+	case "v4":
+		is = netip.Addr.Is4
+	case "v6":
+		is = netip.Addr.Is6
+	default:
+		return nil, fmt.Errorf("illegal ip checker argument '%s'", args)
+	}
+	return CheckFunc(func(seg []byte) error {
+		addr, err := netip.ParseAddr(string(seg))
+		if err != nil || !is(addr) {
+			return fmt.Errorf("not an IP%s address: %s", args, seg)
+		}
+		return nil
+	}), nil
+}
@@ -0,0 +1,84 @@
+package texst
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"git.fractalqb.de/fractalqb/testerr"
+)
+
+func TestCheckers(t *testing.T) {
+	for _, test := range []struct {
+		name, args string
+		ok, fail   []string
+	}{
+		{"int", "1..100", []string{"1", "42", "100"}, []string{"0", "101", "x", ""}},
+		{"int", "", []string{"-7", "0"}, []string{"1.5"}},
+		{"float", "..1", []string{"0.5", "-3", "1"}, []string{"1.01", "a"}},
+		{"duration", "1s..", []string{"1s", "2m3s"}, []string{"999ms", "3"}},
+		{"uuid", "", []string{"123e4567-e89b-12d3-a456-426614174000"}, []string{"123e4567e89b12d3a456426614174000"}},
+		{"hex", "", []string{"deadBEEF", "0"}, []string{"", "0x1"}},
+		{"time", "", []string{"2024-07-01T12:00:00Z", "2024-07-01T12:00:00.5+02:00"}, []string{"2024-07-01 12:00"}},
+		{"time", "15:04:05", []string{"12:00:01"}, []string{"12:00"}},
+		{"ip", "", []string{"10.0.0.1", "::1"}, []string{"10.0.0", "localhost"}},
+		{"ip", "v4", []string{"10.0.0.1"}, []string{"::1"}},
+	} {
+		chk := testerr.Shall1(NewChecker(test.name, test.args)).BeNil(t)
+		for _, s := range test.ok {
+			if err := chk.Check([]byte(s)); err != nil {
+				t.Errorf("%s %s: unexpected error for '%s': %s", test.name, test.args, s, err)
+			}
+		}
+		for _, s := range test.fail {
+			if err := chk.Check([]byte(s)); err == nil {
+				t.Errorf("%s %s: no error for '%s'", test.name, test.args, s)
+			}
+		}
+	}
+	if _, err := NewChecker("int", "1-2"); err == nil {
+		t.Error("no error for illegal int range")
+	}
+	if _, err := NewChecker("no such checker", ""); err == nil {
+		t.Error("no error for unknown checker")
+	}
+}
+
+func TestTexst_checker(t *testing.T) {
+	RegisterChecker(t.Name(), func(args string) (SegChecker, error) {
+		return CheckFunc(func(seg []byte) error {
+			if string(seg) != args {
+				return fmt.Errorf("'%s' is not '%s'", seg, args)
+			}
+			return nil
+		}), nil
+	})
+	ref := testerr.Shall1(NewRefString(t.Name(), `> progress 50% of foo
+ +         xx     yyy
+ !x int 0..100
+ !y `+t.Name()+` foo`)).BeNil(t)
+	var reasons []string
+	txs := Texst{OnReason: func(testedNo int, reason error) {
+		reasons = append(reasons, reason.Error())
+	}}
+	mmn := testerr.Shall1(txs.Check(ref, strings.NewReader("progress 150% of foo"))).BeNil(t)
+	if mmn != 2 {
+		t.Errorf("expected 2 mismatches, got %d", mmn)
+	}
+	if !slices.Equal(reasons, []string{
+		"TestTexst_checker:1: check of mask 'x' failed: 150 greater than 100",
+	}) {
+		t.Error("reasons", reasons)
+	}
+}
+
+func TestTexst_checkerAfterGroups(t *testing.T) {
+	const ref = `> x abc 42
+ .  mmm kk
+ ~m (abc|xyz)
+ !k int 1..50`
+	if reasons := checkRef(t, ref, "x xyz 42", 0); len(reasons) > 0 {
+		t.Error("reasons", reasons)
+	}
+}
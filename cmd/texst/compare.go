@@ -17,6 +17,16 @@ import (
 type compareCmd struct {
 	mlim       int
 	showRegexp bool
+	vars       map[string]string
+	encoding   string
+	maxLineLen int
+	search     int
+}
+
+// rewrite is the last rewritten line of a subject.
+type rewrite struct {
+	no   int
+	line []byte
 }
 
 var cmdCompare compareCmd
@@ -51,6 +61,28 @@ func (cmd *compareCmd) flags(args []string) []string {
 	flags.BoolVar(&cmd.showRegexp, "m", cmd.showRegexp,
 		`Show regular expression of mismatching reference lines`,
 	)
+	flags.StringVar(&cmd.encoding, "e", cmd.encoding,
+		`Override subject encoding: `+strings.Join(texst.Encodings(), ", "),
+	)
+	flags.IntVar(&cmd.maxLineLen, "L", cmd.maxLineLen,
+		`Set maximum length of subject and reference lines in bytes, 0 is unlimited`,
+	)
+	flags.IntVar(&cmd.search, "s", cmd.search,
+		`Search assignment of subject lines to interleaving groups with a budget of backtracks`,
+	)
+	flags.Func("D", `Set value of placeholder ${name} with name=value`,
+		func(arg string) error {
+			name, val, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("expect name=value, have '%s'", arg)
+			}
+			if cmd.vars == nil {
+				cmd.vars = make(map[string]string)
+			}
+			cmd.vars[name] = val
+			return nil
+		},
+	)
 	flags.Parse(args[1:])
 	return flags.Args()
 }
@@ -74,11 +106,28 @@ func (cmd *compareCmd) checkFile(ref, subj string) bool {
 }
 
 func (cmd *compareCmd) checkRd(ref, sname string, subj io.Reader) bool {
+	var rw rewrite
 	cmpr := texst.Texst{
 		MismatchLimit: cmd.mlim,
-		OnMismatch:    cmd.onMismatch,
+		OnMismatch: func(n int, l []byte, ref []*texst.RefLine) {
+			cmd.onMismatch(n, l, ref, &rw)
+		},
+		OnReason:    cmd.onReason,
+		OnForbidden: cmd.onForbidden,
+		OnFilter:    cmd.onFilter,
+		OnRewrite: func(n int, _, line []byte) {
+			rw.no = n
+			rw.line = append(rw.line[:0], line...)
+		},
+		Encoding:     cmd.encoding,
+		MaxLineLen:   cmd.maxLineLen,
+		SearchBudget: cmd.search,
 	}
-	rrd, err := texst.OpenRefFile(ref)
+	opts := []texst.RefOption{texst.WithMaxLineLen(cmd.maxLineLen)}
+	if cmd.vars != nil {
+		opts = append(opts, texst.WithVars(cmd.vars))
+	}
+	rrd, err := texst.OpenRefFile(ref, opts...)
 	if err != nil {
 		log.Println(err)
 		return false
@@ -95,7 +144,7 @@ func (cmd *compareCmd) checkRd(ref, sname string, subj io.Reader) bool {
 	return true
 }
 
-func (cmd *compareCmd) onMismatch(n int, l []byte, ref []*texst.RefLine) {
+func (cmd *compareCmd) onMismatch(n int, l []byte, ref []*texst.RefLine, rw *rewrite) {
 	var sb strings.Builder
 	fmt.Fprintf(&sb, "missmatch in line %d:", n)
 	txtCol := sb.Len()
@@ -105,27 +154,98 @@ func (cmd *compareCmd) onMismatch(n int, l []byte, ref []*texst.RefLine) {
 		fmt.Fprintf(&sb, " [%s]", l)
 	}
 	log.Print(sb.String())
+	if n == rw.no {
+		log.Printf("%s [%s]", strings.Repeat(" ", txtCol-10)+"rewritten:", rw.line)
+		l = rw.line
+	}
 	for _, r := range ref {
 		sb.Reset()
 		fmt.Fprintf(&sb, "ref:%d", r.SourceLine())
-		if cmd.showRegexp {
-			log.Printf("%s%s '%c' ~ %s",
+		if min, max, ok := r.Skip(); ok {
+			log.Printf("%s%s '%s' skip %s",
 				strings.Repeat(" ", txtCol-sb.Len()-4),
 				sb.String(),
-				r.IGroup(),
+				r.IGroupName(),
+				skipCount(min, max),
+			)
+		} else if min, max := r.Repeat(); r.Block() != nil {
+			blk := "block"
+			if r.Unordered() {
+				blk = "unordered block"
+			}
+			log.Printf("%s%s '%s' %s %s",
+				strings.Repeat(" ", txtCol-sb.Len()-4),
+				sb.String(),
+				r.IGroupName(),
+				blk,
+				repeatCount(min, max),
+			)
+		} else if cmd.showRegexp {
+			log.Printf("%s%s '%s' ~ %s",
+				strings.Repeat(" ", txtCol-sb.Len()-4),
+				sb.String(),
+				r.IGroupName(),
 				r.Regexp(),
 			)
 		} else {
-			log.Printf("%s%s '%c' [%s]",
+			fold := ""
+			if r.FoldCase() {
+				fold = " (ignore case)"
+			}
+			log.Printf("%s%s '%s' [%s]%s",
 				strings.Repeat(" ", txtCol-sb.Len()-4),
 				sb.String(),
-				r.IGroup(),
+				r.IGroupName(),
 				withMasks(r, l),
+				fold,
 			)
 		}
 	}
 }
 
+func (cmd *compareCmd) onReason(n int, reason error) {
+	log.Printf("  reason: %s", reason)
+}
+
+func (cmd *compareCmd) onForbidden(n int, l []byte, fl *texst.RefLine) {
+	log.Printf("forbidden line %d: [%s] matches %s:%d [%s]",
+		n,
+		l,
+		fl.SourceName(),
+		fl.SourceLine(),
+		fl.Text(),
+	)
+}
+
+func (cmd *compareCmd) onFilter(f *texst.Filter, dropped int) {
+	log.Printf("filter %s:%d ~ %s dropped %d lines",
+		f.SourceName(),
+		f.SourceLine(),
+		f.Regexp(),
+		dropped,
+	)
+}
+
+func repeatCount(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	}
+	return fmt.Sprintf("{%d,%d}", min, max)
+}
+
+func skipCount(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("%d..", min)
+	case min == max:
+		return fmt.Sprint(min)
+	}
+	return fmt.Sprintf("%d..%d", min, max)
+}
+
 func withMasks(rl *texst.RefLine, sl []byte) string {
 	segs := rl.Masks()
 	if !term.IsTerminal(int(os.Stdout.Fd())) {
@@ -136,15 +256,19 @@ func withMasks(rl *texst.RefLine, sl []byte) string {
 	rpt := 0
 	for _, seg := range segs {
 		if rpt < seg.Start() {
-			part := diffPart(string(sl[rpt:]), txt[rpt:seg.Start()])
+			part := diffPart(string(sl[rpt:]), txt[rpt:seg.Start()], rl.FoldCase())
 			sb.WriteString(part)
 		}
 		rpt = seg.Start() + seg.Len()
-		sb.WriteString(color.InGray(txt[seg.Start():rpt]))
+		if seg.FoldCase() {
+			sb.WriteString(color.InCyan(txt[seg.Start():rpt]))
+		} else {
+			sb.WriteString(color.InGray(txt[seg.Start():rpt]))
+		}
 	}
 	if rpt < len(txt) {
 		if rpt < len(sl) {
-			part := diffPart(string(sl[rpt:]), txt[rpt:])
+			part := diffPart(string(sl[rpt:]), txt[rpt:], rl.FoldCase())
 			sb.WriteString(part)
 		} else {
 			sb.WriteString(txt[rpt:])
@@ -153,10 +277,18 @@ func withMasks(rl *texst.RefLine, sl []byte) string {
 	return sb.String()
 }
 
-func diffPart(sp, rp string) string {
+// diffPart marks the runes of the reference part rp that are equal to the
+// subject part sp. With fold, runes that are only equal when ignoring case are
+// marked as case-folded.
+func diffPart(sp, rp string, fold bool) string {
+	const (
+		isDiff = iota
+		isEQ
+		isFolded
+	)
 	var (
-		isEQ bool
-		sb   strings.Builder
+		state int
+		sb    strings.Builder
 	)
 	sb.WriteString(color.Bold)
 	for i, sr := range sp {
@@ -166,13 +298,25 @@ func diffPart(sp, rp string) string {
 		}
 		rr, rsz := utf8.DecodeRuneInString(rp)
 		rp = rp[rsz:]
-		if i == 0 || isEQ != (sr == rr) {
-			isEQ = sr == rr
-			if isEQ {
+		s := isDiff
+		switch {
+		case sr == rr:
+			s = isEQ
+		case fold && strings.EqualFold(string(sr), string(rr)):
+			s = isFolded
+		}
+		if i == 0 || s != state {
+			state = s
+			switch state {
+			case isEQ:
 				sb.WriteString(color.Reset)
 				sb.WriteString(color.Bold)
 				sb.WriteString(color.Green)
-			} else {
+			case isFolded:
+				sb.WriteString(color.Reset)
+				sb.WriteString(color.Bold)
+				sb.WriteString(color.Yellow)
+			default:
 				sb.WriteString(color.Red)
 				sb.WriteString(color.Underline)
 			}
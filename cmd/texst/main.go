@@ -28,14 +28,70 @@ Maks Types:
    - At least as long as mask
 
 Preamble Lines:
-   %%<interleaving groups>
+   %%<interleaving groups> Each rune is a group, {name,…} declares named
+      groups that are referenced as {name} instead of a single rune g
+   !g<forbidden text> must not match anywhere in any subject line, also in
+      blocks where it applies while the block matches
+
+Global Argument Lines (in preamble and between reference lines):
    *_<global masks> where _ is a mask type
+   *name_<masks> of the mask template name where _ is a mask type
+   *@name Replace global masks with mask template name, *@- removes them
+
+Directives:
+   @include <file> Include reference lines from file
+   @continue <regexp> Matching subject lines continue the previous line,
+      only in preamble
+   @filter <regexp> Drop matching subject lines, only in preamble
+   @replace /<regexp>/<repl>/ Rewrite subject lines, only in preamble
+   @paths Rewrite backslashes in subject lines to slashes, only in preamble
+   @env <name>… Rewrite values of environment variables to $name, only in
+      preamble
+   @space <modes> Set space mode: collapse, trailing, leading or exact
+   @case fold|exact Match following reference lines case-insensitive or not
+   @masks g name [only] Add masks of mask template name to the lines of
+      interleaving group g, with "only" instead of the global masks, only in
+      preamble
+   @instances g m [count] Interleaving group g is a template with one instance
+      for each value of mask m, count as for skip lines, only in preamble
+   @encoding <name> Decode subject from utf-8, latin1, windows-1252, utf-16,
+      utf-16le or utf-16be, only in preamble. With "bytes" each subject byte
+      matches one rune and reference text has escapes \xNN and \\
+   @group g <policy> Set policy of interleaving group g for the end of the
+      subject: optional, truncate or strict, only in preamble
+   @barrier <name> <groups> Declare barrier name of the interleaving groups,
+      e.g. "12{db}", only in preamble
 
 Reference Lines:
    >g<actual reference text> of interleaving group g
+   ?g<optional reference text> of interleaving group g
+   +g<continuation text> of the previous reference line, see @continue
+   |g <barrier> Interleaving group g waits for the other groups of barrier
     _<mask definitions> where _ is a mask type
     ?m <char class> Set character class for non-regexp masks m
     ~m <regexp> Mask m matches <regexp>
+    =m… Masks m… bind their value on first match, later matches must be equal
+    !m <checker> <args> Check masks m with checker: int, float, duration,
+       uuid, hex, time, ip
+    ^m [subject|igroup|none] <layout> Mask m is a timestamp with time layout
+    &m <mark> Set time mark to the timestamp of mask m
+    <m <mark> <range> Bound the gap from time mark to timestamp of mask m
+    @name Add masks of the mask template name, @- removes the global masks
+    _<modes> Set space mode of reference line
+    %m… Masks m… match case-insensitive, without m… the whole line
+    {N,M} Repeat reference line N up to M times, also {N} or {N,}
+    :label Label the reference line
+    >label… Match only after the lines with the labels matched
+
+Blocks:
+   (g Start a block of reference lines of interleaving group g
+   ){N,M} End block and repeat it N up to M times, also {N} or {N,}
+   [g Start an unordered block of reference lines of interleaving group g
+   ]{N,M} End unordered block, repetitions as for blocks
+
+Skip Lines:
+   skipg <count> Skip subject lines in interleaving group g, where <count> is
+                 N, N..M, N.. or *
 `)
 	flag.PrintDefaults()
 }
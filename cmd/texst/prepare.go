@@ -59,6 +59,9 @@ func (cmd *prepareCmd) flags(args []string) []string {
 	flags.BoolVar(&cmd.force, "f", cmd.force,
 		`Force to overwrite existing reference files`,
 	)
+	flags.BoolVar(&cmd.FoldCase, "i", cmd.FoldCase,
+		`Match reference lines case-insensitive`,
+	)
 	flags.Parse(args[1:])
 	return flags.Args()
 }
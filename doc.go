@@ -50,8 +50,8 @@ to mark each timestamp in the reference text line:
 	Jun 27 18:58:11.125 DEBUG [thread1] clearing maps
 	…
 
-To solve this one can set a global mask line in the preamble and. For
-our example one would write:
+To solve this one can set a global mask line in the preamble and
+between reference text specifications. For our example one would write:
 
 	*.ttt tt tt tt tt ttt
 	> Jun 27 21:58:11.112 INFO  [thread1] create `localization dir:test1/test.xCuf/l10n`
@@ -109,6 +109,116 @@ scanning continues with the next subject text line. One can configure
 a maximum number of mismatches that is processed before scanning is
 aborted. By default the complete subject text is scanned.
 
+Lines of any length can be compared. Setting Texst.MaxLineLen limits the
+length of subject lines. A longer line is reported as a mismatch with a
+*LineLengthError as reason and scanning continues with the next line. The
+RefOption WithMaxLineLen limits the length of reference lines.
+
+Assigning a subject line to the first interleaving group that matches can
+fail later, when the line also matches a line of another group and only
+that assignment allows the rest of the subject to match. Setting
+Texst.SearchBudget enables a depth-first search for an assignment of the
+subject lines to interleaving groups that matches the whole subject. The
+search starts at lines that match lines of several groups and backtracks at
+most SearchBudget times. When the budget is exceeded, the line is reported
+as a mismatch with an *AmbiguousError as reason.
+
+# Optional Reference Lines
+
+A reference line that starts with '?' instead of '>' is optional, i.e. a
+subject need not to have a matching line. Otherwise optional reference lines
+are the same as reference lines and can be followed by argument lines:
+
+	> Connecting to server
+	? retrying…
+	> Connected
+
+When an optional line is in question, the next reference lines of the same
+interleaving group are also in question, up to and including the first
+non-optional line. They are tried in the order of the reference text.
+
+# Repetitions and Blocks
+
+A reference line can be repeated with the argument line of type '{', e.g.
+
+	> progress: 10%
+	 .          xx
+	 {1,}
+
+matches one or more progress lines. Repetitions are given as {N} for exactly N
+times, {N,} for at least N times and {N,M} for N up to M times. For optional
+reference lines, the minimum number of repetitions is always 0. Each
+repetition applies the masks of the reference line, including the global
+masks.
+
+To repeat a sequence of reference lines, the lines are put into a block. A
+block starts with a line '(' followed by the interleaving group of the
+block. The block ends with a line ')' that can be followed by the
+repetitions of the block:
+
+	(
+	> request
+	? retry
+	> response
+	){1,}
+
+All lines of a block must be in the interleaving group of the block. Blocks
+can be nested. A reference line or block is repeated as often as possible
+before the next line of the interleaving group is tried. If a mismatch is
+due to the number of repetitions, the violated bound is reported as a reason
+of the mismatch. A block whose lines are all optional can also match no
+subject line at all.
+
+# Unordered Blocks
+
+Sometimes a set of lines always appears at the same position of the subject
+but the order of the lines changes, e.g. when printing a Go map. An
+unordered block starts with a line '[' followed by the interleaving group
+and ends with a line ']':
+
+	> Results:
+	[
+	> apples: 3
+	 .        x
+	> pears: 7
+	 .       x
+	]
+	> Done
+
+Each line of an unordered block must match exactly once in any order.
+Unordered blocks can only contain reference lines, including optional lines
+and repeated lines. They can be repeated like blocks, and each repetition
+requires all its lines to match. An unordered block of only optional lines
+can match no subject line at all. When an unordered block is incomplete, the
+missing lines are reported as a reason of the mismatch. When a subject line
+matches several lines of an unordered block, e.g. due to masks, it is
+assigned to one of them such that as many subject lines as possible match.
+Earlier subject lines are reassigned to other lines if needed.
+
+# Skip Lines
+
+Sometimes a subject has some lines that are not worth to be described, e.g.
+variable startup messages. A skip line makes a number of arbitrary subject
+lines acceptable at its position:
+
+	skip 3
+	> This is the line after three arbitrary lines
+
+A skip line starts with the keyword "skip" followed by the rune of the
+interleaving group and the number of lines to skip:
+
+	skip      Skip exactly one line
+	skip N    Skip exactly N lines
+	skip N..M Skip at least N and at most M lines
+	skip N..  Skip at least N lines
+	skip *    Skip any number of lines, even 0
+
+Once a skip line has skipped its minimum number of lines, the next reference
+line of the same interleaving group is tried before another line is
+skipped. Skip lines only take a subject line if it does not match any
+reference line currently in question. The skipped lines are reported as
+matches of the skip line.
+
 # Types of Argument Lines
 
 TODO: Be more descriptive
@@ -122,6 +232,79 @@ There are the following types of mask lines:
 	1 Part of subject may be of any length >0 up to the length of the mask
 	- Part of subject must be at least as long as the mask
 
+# Checking Masks
+
+The masked subject text can be checked with checkers that are attached to a
+mask with the argument line type '!' followed by the mask name, the name of
+the checker and optional arguments:
+
+	> progress 50%
+	 +         xx
+	 !x int 0..100
+
+The line only matches if the regular expression matches and all checkers
+accept the masked text. A rejected text is reported as reason of the
+mismatch. Built-in checkers are:
+
+	int [lo..hi]      Integer, optionally in the range lo to hi
+	float [lo..hi]    Floating point number, optionally in the range lo to hi
+	duration [lo..hi] Go duration, e.g. 1.5s, optionally in a range
+	uuid              UUID in the format 8-4-4-4-12 hex digits
+	hex               Hexadecimal digits
+	time [layout]     Time in the Go time layout, default is RFC3339
+	ip [v4|v6]        IP address, optionally restricted to IPv4 or IPv6
+
+Either bound of a range can be omitted. Checkers can be added to global masks
+with "*!". Go code can register its own checkers with RegisterChecker.
+
+# Timestamps
+
+A mask can be declared to be a timestamp with the argument line type '^'
+followed by the mask name, an optional order and the Go time layout. Instead
+of a layout one can use the name of a layout constant from package time, e.g.
+StampMilli or DateTime. Timestamps are most useful with global masks:
+
+	*.TTTTTTTTTTTT
+	*^T TimeOnly
+
+The masked text must be a time in the given layout. The order determines how
+the timestamps of one mask name must relate to each other:
+
+	subject  Non-decreasing across the whole subject (default)
+	igroup   Non-decreasing within each interleaving group
+	none     No order
+
+A reference line can set a time mark with the argument line type '&' and
+bound the gap from a time mark with the argument line type '<':
+
+	> 00:00:00.000 request start
+	 &T req
+	> 00:00:00.000 request done
+	 <T req 500ms
+
+The gap is the timestamp of the line minus the timestamp of the time mark. A
+single duration D is the same as the range 0..D, either bound of a range can
+be omitted. Gaps to time marks that were not set fail. Violations are reported
+as reasons of the mismatch.
+
+# Capturing Masks
+
+Masks that have the same name can be made capturing masks with the argument
+line type '=' followed by the mask names:
+
+	> start request 4711
+	 .              rrrr
+	 =r
+	> done request 4711
+	 .             rrrr
+	 =r
+
+The first match of a capturing mask binds the masked subject text to the
+mask's name. All later matches of capturing masks with the same name must
+have exactly the bound value, in any reference line and interleaving
+group. Global masks can be made capturing with "*=". A value conflict is
+reported as reason of the mismatch with the bound and the conflicting value.
+
 # Preamble Lines
 
 The preamble ends with the first reference line. The type of a
@@ -139,6 +322,248 @@ similar as the masks of a reference line are defined:
 	*.xxx yyy
 	*-        zzzzz
 
+Named mask templates are defined with the preamble line type '*' followed by
+the template name and the mask type. The name starts with a letter and
+continues with letters and digits. A reference line adds the masks of a named
+template with the argument line type '@' followed by the template name. The
+name '-' removes the masks of the global template from a reference line:
+
+	*.ttt tt tt tt tt ttt
+	*tbl-         nnnnn
+	> Jun 27 21:58:11.112 INFO  [thread1] print table
+	> Total:   12345
+	 @-
+	 @tbl
+
+The columns of a template count from the column after the mask type. With a
+named template this column is further right than the reference text of the
+lines the template applies to. In the example the masks 'n' cover "12345".
+
+Global argument lines can also be used between reference lines. They extend
+the global template for all later reference lines. The global argument line
+"*@name" replaces the global template with the named template and "*@-"
+removes the global template:
+
+	> Banner
+	*.ttt tt tt tt tt ttt
+	> Jun 27 21:58:11.112 INFO  [thread1] start
+	*@tbl
+	> Total:   12345
+	*@-
+	> Bye
+
+The global template is also used for the lines of included files and changes
+in included files apply to the lines after the include directive.
+
+When interleaving groups come from components with different line formats,
+the directive "@masks" makes a named template the global template of one
+group. Its masks apply to the reference lines of the group in addition to
+the global template, or instead of it with the argument "only". The template
+name '-' removes the group's template. The directive is only allowed in the
+preamble after the declaration of the interleaving groups:
+
+	%%12
+	*.ttt tt tt tt tt ttt
+	*json.         tttttttttttttttttttttttt
+	@masks 2 json only
+	>1Jun 27 21:58:11.112 INFO  started
+	>2{"time":"2024-06-27T21:58:11.112Z","msg":"started"}
+
+The argument line " @-" of a reference line removes the masks of both
+templates.
+
+# Forbidden Lines
+
+Forbidden lines start with the tag '!' followed by the interleaving group and
+a text that must not match anywhere in any subject line. Forbidden lines can
+have argument lines with masks like reference lines but do not use the global
+mask template:
+
+	! panic:
+	! ERROR
+	> Jun 27 21:58:11.112 INFO  [thread1] start
+
+Forbidden lines in the preamble apply to all subject lines, no matter if a
+subject line matches a reference line. Forbidden lines in a block apply to the
+subject lines from the first to the last match of the block. Forbidden lines
+of a block must be in the interleaving group of the block. Each subject line
+that matches a forbidden line counts as mismatch and is reported with
+Texst.OnForbidden.
+
+# Directives
+
+Directive lines start with '@' followed by a keyword and an optional
+argument, separated by a space. Directives can be used in the preamble and
+in the body of a reference text specification.
+
+	@include <file>
+
+splices the lines of another reference file in at the position of the
+directive. Relative file names are resolved relative to the directory of the
+including file. Lines from an included file keep their own source name and
+line number, i.e. mismatches are reported for the included file. Included
+files can include other files as long as there is no cycle.
+
+	@filter <regexp>
+
+drops all subject lines that match the regular expression anywhere before
+they are compared to the reference lines, see Subject Filters.
+
+	@replace /<regexp>/<replacement>/
+	@paths
+	@env <name>…
+
+rewrite subject lines before they are compared, see Subject Rewrites.
+
+	@space <modes>
+
+sets the space mode for all following reference lines, see Whitespace.
+
+	@case fold|exact
+
+switches case-insensitive matching on or off for all following reference
+lines, see Letter Case.
+
+# Variables
+
+Reference texts can have placeholders ${NAME} for values that are only known
+when the check runs, e.g. the path of a temporary directory. The values are
+given with the option WithVars when the RefReader is created or with "-D
+NAME=value" on "texst compare". The values are matched literally. Mask
+columns refer to the reference text with the placeholders and masks must not
+overlap placeholders:
+
+	> write ${DIR}/out.txt id=00
+	 .                        ii
+
+Without WithVars placeholders are plain reference text. With WithVars a
+placeholder without value is an error. Prepare replaces the values of its
+Vars with placeholders.
+
+# Subject Records
+
+Stack traces or wrapped log messages span several subject lines. The
+preamble directive "@continue <regexp>" makes each subject line that matches
+the regular expression a continuation of the previous line. A line together
+with its continuation lines is a record that is matched as one unit. Thus the
+continuation lines cannot interleave with lines of other interleaving groups.
+
+A reference line matches a record if it has the continuation lines with tag
+'+' followed by the interleaving group of the reference line and the text of
+the continuation line. Argument lines after a continuation line define masks
+relative to the continuation text:
+
+	@continue ^\s
+	> panic: boom
+	+ 	at main.go:42
+	 .            nn
+
+The subject line numbers of records are the numbers of their first lines.
+Rewrites and filters apply to whole records.
+
+# Subject Filters
+
+Subject filters are declared in the preamble with the directive "@filter"
+followed by a regular expression. Subject lines that match the regular
+expression of any filter are dropped before matching, e.g. debug lines of a
+library or blank lines:
+
+	@filter ^DEBUG\b
+	@filter ^\s*$
+
+Dropped lines keep their line numbers and forbidden lines also apply to them.
+After the check Texst.OnFilter is called with the number of lines each filter
+dropped.
+
+# Subject Rewrites
+
+Subject lines can be rewritten before they are filtered and compared to the
+reference lines. Rewrites are declared in the preamble and are applied in the
+order of their declaration:
+
+	@replace /<regexp>/<replacement>/
+
+replaces all matches of the regular expression with the replacement that can
+refer to submatches with $1 or ${name}. The first rune of the argument is the
+delimiter, e.g. "@replace |[0-9]+ms|Nms|".
+
+	@paths
+
+replaces all backslashes with slashes to normalize path separators.
+
+	@env <name>…
+
+replaces the values of the environment variables with the placeholders $name,
+e.g. "@env HOME TMPDIR" replaces the path of the home directory with "$HOME".
+Longer values are replaced first, so a TMPDIR inside of HOME becomes
+"$TMPDIR". Unset or empty variables are ignored.
+
+The callbacks of Texst get the original subject line. Texst.OnMatch also gets
+the rewritten line that its match indices refer to. Texst.OnRewrite is called
+with the original and the rewritten text of each changed line before the line
+is matched.
+
+# Whitespace
+
+By default the whitespace of the reference text has to match the subject text
+exactly. The space mode relaxes this and is a list of the following modes,
+separated by spaces or commas:
+
+	collapse  Runs of whitespace match any non-empty run of whitespace
+	trailing  Ignore trailing whitespace
+	leading   Ignore leading whitespace, i.e. indentation
+	exact     Reset the modes given before
+
+The directive "@space <modes>" sets the space mode for all following reference
+lines. The argument line type '_' sets the space mode of one reference line:
+
+	> Name     Size
+	 _collapse trailing
+
+The space mode applies to the literal text of a reference line, including the
+whitespace around masks. It does not change what a mask matches.
+
+# Letter Case
+
+Reference lines match case-sensitive by default. The directive "@case fold"
+makes all following reference lines match case-insensitive, "@case exact"
+switches back. The argument line type '%' without mask names makes one
+reference line case-insensitive. With mask names only the named masks match
+case-insensitive:
+
+	> id=abcd level=INFO
+	 .   hhhh       llll
+	 ?h [0-9a-f]
+	 %h
+
+Global masks can match case-insensitive with "*%". The prepare command of
+the texst CLI writes "@case fold" with the flag -i.
+
+# Subject Encoding
+
+Reference files are UTF-8. Subjects in another encoding are decoded to UTF-8
+before matching when the preamble declares the encoding with the directive
+"@encoding", e.g. "@encoding latin1". Supported encodings are utf-8 (the
+default), latin1, windows-1252, utf-16, utf-16le and utf-16be. With utf-16
+the byte order is taken from the byte order mark. The field Texst.Encoding
+and the flag -e of the compare command override the declared encoding.
+
+Subjects that have no text encoding at all can be compared byte-exact with
+"@encoding bytes". Then each subject byte matches one rune of the reference
+text, i.e. the UTF-8 encoding of the reference text is matched byte by byte.
+The escape sequence \xNN in the literal reference text matches the byte
+with the hex value NN and \\ matches a backslash:
+
+	@encoding bytes
+	> magic \x89PNG
+	> size: 4096 bytes \xff\x00
+	 .      ....
+
+Masks count the runes of the reference text as usual. The fixed-length mask
+above matches exactly 4 subject bytes, while each of the two escape sequences
+after it matches one byte. Escape sequences must not overlap masks. Mismatching subject lines are
+reported with each byte shown as Latin-1 character.
+
 # Interleaving Groups
 
 Interleaving groups are identified by a single rune and have to be
@@ -159,6 +584,119 @@ used, the groups had to be declared in the preamble line.
 Interleaving groups are defined once in the preamble in a line
 starting with '%%'.
 
+Groups can also have names that are declared in braces, separated by
+commas, and are referenced in braces instead of a single rune:
+
+	%%1{db,http}
+	>{db}connect
+	>{http}GET /index.html
+	>1started
+	skip{db} *
+
+Named groups can be used wherever a single rune group can be used, e.g. in
+blocks "({db}" and with "@instances {http} r". Mismatches are reported with
+the group names. A name with a single rune is the same as that rune. Each
+group can be declared only once, e.g. "%%a{a}" is an error.
+
+Masks line up with the reference text they describe. The mask lines of a
+reference line with a named group are aligned with the text after the group
+name, the columns in front of the text must be blank:
+
+	>{http}GET /index.html
+	 .         m
+
+Here the mask 'm' covers "/". The same applies to continuation lines. Mask
+templates are not tied to a reference line, their columns count from the
+column after the mask type as described in Preamble Lines.
+
+# Group Templates
+
+When a subject has a variable number of similar line sequences, e.g. from
+worker goroutines, an interleaving group can be a template for group
+instances. The directive "@instances" in the preamble names the group, the
+key mask and optionally the number of instances with the syntax of skip
+lines:
+
+	%% w
+	@instances w k 1..
+	> main start
+	>wworker 0 start
+	 .       k
+	>wworker 0 done
+	 .       k
+	> main end
+
+Each distinct value of the key mask in the subject selects its own
+instance of the group. A subject line whose key has no instance yet starts
+a new instance at the first line of the group. Each instance has to match
+the lines of the group in order. All reference lines of a group template
+must have the key mask, global masks included. A subject line that would
+exceed the maximum number of instances and too few instances at the end of
+the subject are mismatches with an *InstanceError as reason. References
+with group templates are read into memory.
+
+# Synchronizing Interleaving Groups
+
+Interleaving groups match independently of each other. A barrier makes
+groups wait for each other. The directive "@barrier" in the preamble
+declares the name of the barrier and the participating groups. Each of the
+groups has a barrier line with the tag '|' at the position where it waits:
+
+	%%mw
+	@barrier done mw
+	>mstart
+	>wwork
+	|w done
+	|m done
+	>mshutdown
+
+A group cannot match the lines behind its barrier line until all
+participating groups have reached their barrier lines, i.e. they have no
+more lines in front of the barrier line that need to match. In the example
+"shutdown" only matches after "work". Barrier lines must not be in blocks
+and not in group templates. Once a barrier is released, the lines in front
+of the barrier lines can no longer match. References with barriers are read
+into memory.
+
+Finer constraints are happens-before edges between two reference lines. The
+argument line " :name" labels a reference line and the argument line
+" >name…" lets a reference line only match after the lines with the given
+labels matched:
+
+	%%12
+	>1ready
+	 :r
+	>2go
+	 >r
+
+Labels are unique and each label used with " >" must label a line
+somewhere in the reference. Otherwise reading the reference fails at its
+end.
+
+A subject line that would match a reference line if it were not for a
+barrier or a happens-before edge is a mismatch with a *BarrierError or an
+*OrderError as reason.
+
+# Group Policies
+
+At the end of the subject, all reference lines of all interleaving groups
+must have matched. The directive "@group" in the preamble sets a different
+policy for an interleaving group after the declaration of the groups, see
+ParseGroupPolicy:
+
+	%%mw
+	@group w optional truncate
+
+With "optional" the group may be absent from the subject. But once a line of
+the group matched, the group must be complete. With "truncate" the subject
+may end anywhere in the group once a line of the group matched, e.g. because
+the process was killed. Both together allow the group to be absent or
+incomplete. Matches of skip lines do not start a group. An optional group
+that did not start counts as having reached its barriers. When another
+group went past such a barrier, the optional group stays absent. The instances of a
+group template are always started and an optional group template may have
+no instances.
+
 TODO: What do these groups do (see "Matching Reference Lines")? => Ambiguities &
 Order of IGroups
 */
@@ -0,0 +1,238 @@
+package texst
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Subject encodings
+const (
+	// The default encoding, subjects are not decoded.
+	EncUTF8 = "utf-8"
+
+	// ISO 8859-1
+	EncLatin1 = "latin1"
+
+	// Windows code page 1252
+	EncWindows1252 = "windows-1252"
+
+	// UTF-16 with byte order mark, big endian without byte order mark.
+	EncUTF16 = "utf-16"
+
+	// UTF-16 little endian
+	EncUTF16LE = "utf-16le"
+
+	// UTF-16 big endian
+	EncUTF16BE = "utf-16be"
+
+	// Byte-exact mode: Each subject byte is matched as one rune, i.e. the
+	// subject is decoded as Latin-1. The reference text is encoded as UTF-8
+	// and can have the escape sequences \xNN for the byte NN and \\ for a
+	// backslash.
+	EncBytes = "bytes"
+)
+
+var encAliases = map[string]string{
+	"utf8":       EncUTF8,
+	"iso-8859-1": EncLatin1,
+	"iso8859-1":  EncLatin1,
+	"latin-1":    EncLatin1,
+	"cp1252":     EncWindows1252,
+	"utf16":      EncUTF16,
+	"utf16le":    EncUTF16LE,
+	"utf16be":    EncUTF16BE,
+}
+
+// Encodings returns the names of the supported subject encodings.
+func Encodings() []string {
+	return []string{
+		EncUTF8,
+		EncLatin1,
+		EncWindows1252,
+		EncUTF16,
+		EncUTF16LE,
+		EncUTF16BE,
+		EncBytes,
+	}
+}
+
+// ParseEncoding returns the canonical name of the subject encoding enc. The
+// empty string is EncUTF8.
+func ParseEncoding(enc string) (string, error) {
+	enc = strings.ToLower(enc)
+	switch {
+	case enc == "":
+		return EncUTF8, nil
+	case slices.Contains(Encodings(), enc):
+		return enc, nil
+	}
+	if a, ok := encAliases[enc]; ok {
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown encoding '%s'", enc)
+}
+
+// decodeSubject returns a reader that decodes r from the encoding enc to
+// UTF-8.
+func decodeSubject(r io.Reader, enc string) io.Reader {
+	switch enc {
+	case EncLatin1, EncBytes:
+		return &decoder{r: r, decode: decodeSingleByte(nil)}
+	case EncWindows1252:
+		return &decoder{r: r, decode: decodeSingleByte(&windows1252)}
+	case EncUTF16:
+		return &decoder{r: r, decode: decodeUTF16(nil)}
+	case EncUTF16LE:
+		return &decoder{r: r, decode: decodeUTF16(littleEndian)}
+	case EncUTF16BE:
+		return &decoder{r: r, decode: decodeUTF16(bigEndian)}
+	}
+	return r
+}
+
+// decoder is an io.Reader that decodes the bytes from r to UTF-8. The decode
+// function appends the decoded runes from src to dst and returns the number
+// of consumed bytes. It consumes all bytes if eof is true.
+type decoder struct {
+	r      io.Reader
+	decode func(dst, src []byte, eof bool) ([]byte, int)
+	in     []byte
+	out    []byte
+	err    error
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.in == nil {
+			d.in = make([]byte, 0, 4096)
+		}
+		n, err := d.r.Read(d.in[len(d.in):cap(d.in)])
+		d.in = d.in[:len(d.in)+n]
+		d.err = err
+		var used int
+		d.out, used = d.decode(d.out[:0], d.in, err != nil)
+		d.in = d.in[:copy(d.in, d.in[used:])]
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func decodeSingleByte(table *[128]rune) func(dst, src []byte, eof bool) ([]byte, int) {
+	return func(dst, src []byte, _ bool) ([]byte, int) {
+		for _, b := range src {
+			r := rune(b)
+			if table != nil && b >= 0x80 {
+				r = table[b-0x80]
+			}
+			dst = utf8.AppendRune(dst, r)
+		}
+		return dst, len(src)
+	}
+}
+
+type byteOrder func(b []byte) uint16
+
+func littleEndian(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 }
+func bigEndian(b []byte) uint16    { return uint16(b[0])<<8 | uint16(b[1]) }
+
+// decodeUTF16 decodes UTF-16 with the byte order bo. If bo is nil, the byte
+// order is taken from the byte order mark with big endian as default.
+func decodeUTF16(bo byteOrder) func(dst, src []byte, eof bool) ([]byte, int) {
+	start := true
+	return func(dst, src []byte, eof bool) ([]byte, int) {
+		used := 0
+		if start {
+			if len(src) < 2 && !eof {
+				return dst, 0
+			}
+			start = false
+			if len(src) >= 2 {
+				switch {
+				case src[0] == 0xfe && src[1] == 0xff:
+					used, bo = 2, bigEndian
+				case src[0] == 0xff && src[1] == 0xfe:
+					used, bo = 2, littleEndian
+				case bo == nil:
+					bo = bigEndian
+				default:
+					if bo(src) == 0xfeff {
+						used = 2
+					}
+				}
+			}
+		}
+		for len(src)-used >= 2 {
+			r := rune(bo(src[used:]))
+			if utf16.IsSurrogate(r) {
+				if len(src)-used < 4 {
+					if !eof {
+						return dst, used
+					}
+				} else {
+					r = utf16.DecodeRune(r, rune(bo(src[used+2:])))
+					if r != utf8.RuneError {
+						used += 2
+					}
+				}
+			}
+			dst = utf8.AppendRune(dst, r)
+			used += 2
+		}
+		if eof && used < len(src) {
+			dst = utf8.AppendRune(dst, utf8.RuneError)
+			used = len(src)
+		}
+		return dst, used
+	}
+}
+
+var windows1252 = [128]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+func init() {
+	for i := 0x20; i < 0x80; i++ {
+		windows1252[i] = rune(0x80 + i)
+	}
+}
+
+// byteText encodes the reference text s for the byte-exact mode. Each byte
+// of the UTF-8 encoding of s and each escape sequence \xNN becomes one rune
+// with the value of the byte. The escape sequence \\ is a backslash.
+func byteText(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case '\\':
+				i++
+			case 'x':
+				if i+4 > len(s) {
+					return "", errors.New("incomplete escape sequence")
+				}
+				v, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("illegal escape sequence '%s'", s[i:i+4])
+				}
+				b = byte(v)
+				i += 3
+			}
+		}
+		sb.WriteRune(rune(b))
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,162 @@
+package texst
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A GroupTemplate makes the reference lines of an interleaving group a
+// template for group instances. The value of the key mask in a matching
+// subject line selects the instance. Each distinct key creates a new
+// instance that matches the reference lines of the group from the start.
+// Group templates are declared in the preamble with DirInstances.
+type GroupTemplate struct {
+	srcName  string
+	srcLine  int
+	igName   rune
+	igLabel  string
+	key      rune
+	min, max int
+}
+
+func (gt *GroupTemplate) SourceName() string { return gt.srcName }
+func (gt *GroupTemplate) SourceLine() int    { return gt.srcLine }
+
+// IGroup returns the interleaving group that is the template.
+func (gt *GroupTemplate) IGroup() rune { return gt.igName }
+
+// IGroupName returns the name of the interleaving group that is the
+// template.
+func (gt *GroupTemplate) IGroupName() string { return gt.igLabel }
+
+// Key returns the name of the mask that selects the group instance.
+func (gt *GroupTemplate) Key() rune { return gt.key }
+
+// Instances returns the bounds for the number of group instances. A negative
+// max means there is no upper bound.
+func (gt *GroupTemplate) Instances() (min, max int) { return gt.min, gt.max }
+
+// InstanceError explains a mismatch that violates the number of instances of
+// a group template.
+type InstanceError struct {
+	Template *GroupTemplate
+	Count    int    // Number of instances
+	Key      string // Key of the rejected instance if Count reached the maximum
+}
+
+func (e *InstanceError) Error() string {
+	if e.Count < e.Template.min {
+		return fmt.Sprintf("%s:%d: group '%s' has %d instances, expected at least %d",
+			e.Template.SourceName(),
+			e.Template.SourceLine(),
+			e.Template.IGroupName(),
+			e.Count,
+			e.Template.min,
+		)
+	}
+	return fmt.Sprintf("%s:%d: group '%s' instance '%s' exceeds maximum of %d instances",
+		e.Template.SourceName(),
+		e.Template.SourceLine(),
+		e.Template.IGroupName(),
+		e.Key,
+		e.Template.max,
+	)
+}
+
+// instance is an instance of a group template selected by key.
+type instance struct {
+	key string
+	pos cursor
+}
+
+// instanceKey restricts the matches of template lines to the key of an
+// instance or, with fresh, to keys without an instance.
+type instanceKey struct {
+	mask  rune
+	value string
+	fresh bool
+	insts []instance
+}
+
+// accept reports if the match of rl selects the instance of k. Lines without
+// the key mask, e.g. skip lines, are accepted.
+func (k *instanceKey) accept(rl *RefLine, line []byte, match []int) bool {
+	v, ok := keyValue(rl, k.mask, line, match)
+	switch {
+	case !ok:
+		return true
+	case k.fresh:
+		return !slices.ContainsFunc(k.insts, func(in instance) bool { return in.key == v })
+	}
+	return v == k.value
+}
+
+// keyValue returns the subject text of the first mask of rl named key.
+func keyValue(rl *RefLine, key rune, line []byte, match []int) (string, bool) {
+	for i, m := range rl.masks {
+		if m.name == key {
+			return string(rl.segment(line, match, i)), true
+		}
+	}
+	return "", false
+}
+
+// hasKey reports if rl has a mask named key.
+func (rl *RefLine) hasKey(key rune) bool {
+	return slices.ContainsFunc(rl.masks, func(m *Mask) bool { return m.name == key })
+}
+
+// stepInstances matches the subject line with the instances of the template
+// group ig in the order of their creation. If no instance matches, a line
+// that matches from the start of the template with a new key creates a new
+// instance. Skip lines do not create instances.
+func (ig *igState) stepInstances(mc *matchCtx) (*RefLine, []int) {
+	defer func() { mc.key = nil }()
+	tried := len(mc.tried)
+	for i := range ig.insts {
+		in := &ig.insts[i]
+		mc.key = &instanceKey{mask: ig.tmpl.key, value: in.key}
+		if next, rl, match := in.pos.step(mc); rl != nil {
+			in.pos = next
+			return rl, match
+		}
+	}
+	if mc.skip {
+		return nil, nil
+	}
+	mc.key = &instanceKey{mask: ig.tmpl.key, fresh: true, insts: ig.insts}
+	next, rl, match := (cursor{at: ig.first}).step(mc)
+	// Instances at the same line try it again
+	for i := len(mc.tried) - 1; i >= tried; i-- {
+		if slices.Contains(mc.tried[tried:i], mc.tried[i]) {
+			mc.tried = slices.Delete(mc.tried, i, i+1)
+		}
+	}
+	if rl == nil {
+		return nil, nil
+	}
+	key, _ := keyValue(rl, ig.tmpl.key, mc.line, match)
+	if ig.tmpl.max >= 0 && len(ig.insts) >= ig.tmpl.max {
+		mc.reasons = append(mc.reasons, &InstanceError{
+			Template: ig.tmpl,
+			Count:    len(ig.insts),
+			Key:      key,
+		})
+		return nil, nil
+	}
+	ig.insts = append(ig.insts, instance{key: key, pos: next})
+	return rl, match
+}
+
+// cursors returns the cursors of the instances of a template group or the
+// cursor of any other group.
+func (ig *igState) cursors() []cursor {
+	if ig.tmpl == nil {
+		return []cursor{ig.cursor()}
+	}
+	cs := make([]cursor, len(ig.insts))
+	for i := range ig.insts {
+		cs[i] = ig.insts[i].pos
+	}
+	return cs
+}
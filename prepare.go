@@ -5,10 +5,19 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"slices"
+	"strings"
 )
 
 type Prepare struct {
 	DefaultIGroup rune
+	// FoldCase starts the reference text with the directive to match all
+	// reference lines case-insensitive.
+	FoldCase bool
+	// Vars replaces the values of the variables with the placeholders
+	// ${NAME} in the reference text, longer values first.
+	Vars map[string]string
 }
 
 func (p Prepare) Text(ref io.Writer, subj io.Reader) (err error) {
@@ -17,22 +26,54 @@ func (p Prepare) Text(ref io.Writer, subj io.Reader) (err error) {
 	} else if p.DefaultIGroup != ' ' {
 		fmt.Fprintf(ref, "%%%%%c\n", p.DefaultIGroup)
 	}
+	if p.FoldCase {
+		fmt.Fprintf(ref, "%c%s fold\n", TagDirective, DirCase)
+	}
 	var sep lineSepScanner
 	scn := bufio.NewScanner(subj)
+	scn.Buffer(nil, math.MaxInt)
 	scn.Split(sep.ScanLines)
 	prefix := []byte{TagRefLine, byte(p.DefaultIGroup)}
+	repl := p.varsReplacer()
 	for scn.Scan() {
 		if _, err = ref.Write(prefix); err != nil {
 			return err
 		}
-		if _, err = ref.Write(scn.Bytes()); err != nil {
+		line := scn.Bytes()
+		if repl != nil {
+			line = []byte(repl.Replace(string(line)))
+		}
+		if _, err = ref.Write(line); err != nil {
 			return err
 		}
 		if _, err = ref.Write(sep); err != nil {
 			return err
 		}
 	}
-	return nil
+	return scn.Err()
+}
+
+func (p Prepare) varsReplacer() *strings.Replacer {
+	names := make([]string, 0, len(p.Vars))
+	for n, v := range p.Vars {
+		if v != "" {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	slices.SortFunc(names, func(m, n string) int {
+		if c := len(p.Vars[n]) - len(p.Vars[m]); c != 0 {
+			return c
+		}
+		return strings.Compare(m, n)
+	})
+	var oldnew []string
+	for _, n := range names {
+		oldnew = append(oldnew, p.Vars[n], "${"+n+"}")
+	}
+	return strings.NewReplacer(oldnew...)
 }
 
 type lineSepScanner []byte
@@ -4,41 +4,335 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"regexp/syntax"
 	"slices"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type RefLine struct {
 	lineTemplate
-	igName rune
-	text   string
-	rgx    *regexp.Regexp
-	lsNext *RefLine
+	igName   rune
+	igLabel  string
+	text     string
+	rgx      *regexp.Regexp
+	subx     []int // Subexpression of each mask in rgx
+	kind     lineKind
+	space    SpaceMode
+	fold     bool     // Case-insensitive match
+	bytes    bool     // Byte-exact mode, see EncBytes
+	min, max int      // Number of repetitions, max < 0 is unbounded
+	sub      *RefLine // First line of a block
+	forbid   []*RefLine
+	marks    []timeMark
+	gaps     []timeGap
+	label    string   // Label for happens-before constraints
+	after    []string // Labels of lines that must match before
+	lsNext   *RefLine
 }
 
-func (rl *RefLine) IGroup() rune   { return rl.igName }
-func (rl *RefLine) Text() string   { return rl.text }
-func (rl *RefLine) Regexp() string { return rl.rgx.String() }
+type lineKind int8
+
+const (
+	textLine lineKind = iota
+	skipLine
+	blockLine
+	setLine
+	forbidLine
+	barrierLine
+)
+
+// SpaceMode controls how the whitespace of the reference text is compared to
+// the subject text. Modes can be combined.
+type SpaceMode uint8
+
+const (
+	// Runs of whitespace match any non-empty run of whitespace.
+	SpaceCollapse SpaceMode = 1 << iota
+	// Ignore trailing whitespace.
+	SpaceTrailing
+	// Ignore leading whitespace, i.e. indentation.
+	SpaceLeading
+
+	// Compare whitespace exactly. This is the default.
+	SpaceExact SpaceMode = 0
+)
+
+// flagNames names the values of a flag set type F. The names are parsed
+// separated by spaces or commas.
+type flagNames[F ~uint8] struct {
+	what string   // What the flags are for error messages
+	zero string   // Name of the zero value that resets all flags
+	bits []string // Names of the flags 1<<i
+}
+
+func (fn *flagNames[F]) parse(s string) (flags F, err error) {
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if name == fn.zero {
+			flags = 0
+			continue
+		}
+		i := slices.Index(fn.bits, name)
+		if i < 0 {
+			return 0, fmt.Errorf("illegal %s '%s'", fn.what, name)
+		}
+		flags |= 1 << i
+	}
+	return flags, nil
+}
+
+func (fn *flagNames[F]) format(flags F) string {
+	if flags == 0 {
+		return fn.zero
+	}
+	var names []string
+	for i, n := range fn.bits {
+		if flags&(1<<i) != 0 {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+var spaceModeNames = flagNames[SpaceMode]{
+	what: "space mode",
+	zero: "exact",
+	bits: []string{"collapse", "trailing", "leading"},
+}
+
+// ParseSpaceMode parses space mode names "collapse", "trailing" and "leading"
+// separated by spaces or commas. The name "exact" resets the mode.
+func ParseSpaceMode(s string) (SpaceMode, error) { return spaceModeNames.parse(s) }
+
+func (m SpaceMode) String() string { return spaceModeNames.format(m) }
+
+func (rl *RefLine) IGroup() rune { return rl.igName }
+
+// IGroupName returns the name of the interleaving group of rl. For groups
+// that are declared with a single rune this is the rune.
+func (rl *RefLine) IGroupName() string { return rl.igLabel }
+func (rl *RefLine) Text() string       { return rl.text }
+
+// Optional reports if rl need not to match any subject line.
+func (rl *RefLine) Optional() bool { return rl.min == 0 }
+
+// FoldCase reports if the text of rl matches case-insensitive.
+func (rl *RefLine) FoldCase() bool { return rl.fold }
+
+// Space returns the space mode that applies to the text of rl.
+func (rl *RefLine) Space() SpaceMode { return rl.space }
+
+func (rl *RefLine) Regexp() string {
+	if rl.rgx == nil {
+		return ""
+	}
+	return rl.rgx.String()
+}
+
+// Repeat returns the bounds for the number of times rl has to match. A
+// negative max means there is no upper bound.
+func (rl *RefLine) Repeat() (min, max int) { return rl.min, rl.max }
+
+// Skip reports if rl is a skip line. If so, min and max are the bounds for the
+// number of subject lines to skip. A negative max means there is no upper
+// bound.
+func (rl *RefLine) Skip() (min, max int, ok bool) {
+	return rl.min, rl.max, rl.kind == skipLine
+}
+
+// Block returns the lines of rl if rl is a block of reference lines. Otherwise
+// it returns nil. Blocks can be ordered or unordered, see Unordered.
+func (rl *RefLine) Block() (lines []*RefLine) {
+	for sub := rl.sub; sub != nil; sub = sub.lsNext {
+		lines = append(lines, sub)
+	}
+	return lines
+}
+
+func (rl *RefLine) blockLen() (n int) {
+	for sub := rl.sub; sub != nil; sub = sub.lsNext {
+		n++
+	}
+	return n
+}
+
+// Forbidden returns the forbidden lines of rl if rl is a block. They must not
+// match any subject line while the block is matched.
+func (rl *RefLine) Forbidden() []*RefLine { return rl.forbid }
+
+// Unordered reports if rl is an unordered block of reference lines.
+func (rl *RefLine) Unordered() bool { return rl.kind == setLine }
+
+// Barrier reports if rl is a barrier line. If so, name is the name of the
+// barrier.
+func (rl *RefLine) Barrier() (name string, ok bool) {
+	return rl.text, rl.kind == barrierLine
+}
+
+// Label returns the label of rl that other lines use to match after rl, see
+// ArgLabel.
+func (rl *RefLine) Label() string { return rl.label }
+
+// After returns the labels of the lines that must match before rl, see
+// ArgAfter.
+func (rl *RefLine) After() []string { return rl.after }
+
+func (rl *RefLine) mayRepeat(n int) bool { return rl.max < 0 || n < rl.max }
 
 func (rl *RefLine) match(line []byte) (match []int) {
 	match = rl.rgx.FindSubmatchIndex(line)
 	return match
 }
 
-func (rl *RefLine) regexp() string {
+// segment returns the text of the mask i of rl in line where match is the
+// result of rl.match.
+func (rl *RefLine) segment(line []byte, match []int, i int) []byte {
+	x := 2 * rl.subx[i]
+	return line[match[x]:match[x+1]]
+}
+
+// regexp returns the regular expression for rl where the placeholders ${NAME}
+// in the literal text are replaced with the values from vars. Without vars
+// the placeholders are literal text. It records the subexpression of each
+// mask in rl.subx because the regular expressions of masks can have groups.
+func (rl *RefLine) regexp(vars map[string]string) string {
 	var sb strings.Builder
-	sb.WriteRune('^')
+	if rl.fold {
+		sb.WriteString("(?i)")
+	}
+	anchor := rl.kind != forbidLine // Forbidden lines match anywhere
+	if anchor {
+		sb.WriteRune('^')
+	}
+	if rl.space&SpaceLeading != 0 {
+		sb.WriteString(`\s*`)
+	}
 	ln := []rune(rl.text)
 	lidx := 0
-	for _, seg := range rl.masks {
+	rl.subx = make([]int, len(rl.masks))
+	subx := 1
+	for i, seg := range rl.masks {
 		if lidx < seg.start {
-			sb.WriteString(regexp.QuoteMeta(string(ln[lidx:seg.start])))
+			rl.writeLiteral(&sb, expandVars(string(ln[lidx:seg.start]), vars), lidx == 0, false)
 		}
 		lidx = seg.end()
 		seg.writeRegexp(&sb)
+		rl.subx[i] = subx
+		subx += 1 + seg.groups()
+	}
+	rl.writeLiteral(&sb, expandVars(string(ln[lidx:]), vars), lidx == 0, true)
+	if rl.space&SpaceTrailing != 0 {
+		sb.WriteString(`\s*`)
+	}
+	if anchor {
+		sb.WriteRune('$')
 	}
-	sb.WriteString(regexp.QuoteMeta(string(ln[lidx:])))
-	sb.WriteRune('$')
+	return sb.String()
+}
+
+// writeLiteral writes the regexp for the literal text txt with respect to
+// the space mode of rl. The flags first and last tell if txt is at the start
+// or the end of the reference text.
+func (rl *RefLine) writeLiteral(sb *strings.Builder, txt string, first, last bool) {
+	quote := regexp.QuoteMeta
+	if rl.bytes {
+		quote = func(s string) string {
+			s, _ = byteText(s)
+			return regexp.QuoteMeta(s)
+		}
+	}
+	if first && rl.space&SpaceLeading != 0 {
+		txt = strings.TrimLeftFunc(txt, unicode.IsSpace)
+	}
+	if last && rl.space&SpaceTrailing != 0 {
+		txt = strings.TrimRightFunc(txt, unicode.IsSpace)
+	}
+	if rl.space&SpaceCollapse == 0 {
+		sb.WriteString(quote(txt))
+		return
+	}
+	for txt != "" {
+		i := strings.IndexFunc(txt, unicode.IsSpace)
+		if i < 0 {
+			sb.WriteString(quote(txt))
+			return
+		}
+		sb.WriteString(quote(txt[:i]))
+		sb.WriteString(`\s+`)
+		txt = strings.TrimLeftFunc(txt[i:], unicode.IsSpace)
+	}
+}
+
+// checkBytes checks the escape sequences in the literal text of rl, see
+// EncBytes.
+func (rl *RefLine) checkBytes() error {
+	ln := []rune(rl.text)
+	lidx := 0
+	for _, seg := range rl.masks {
+		if _, err := byteText(string(ln[lidx:seg.start])); err != nil {
+			return err
+		}
+		lidx = seg.end()
+	}
+	_, err := byteText(string(ln[lidx:]))
+	return err
+}
+
+// placeholder is a variable placeholder ${name} in a reference text from rune
+// column start up to end.
+type placeholder struct {
+	name       string
+	start, end int
+}
+
+// placeholders returns the placeholders in s. An unterminated placeholder is
+// literal text.
+func placeholders(s string) (ps []placeholder) {
+	col := 0
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			return ps
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return ps
+		}
+		start := col + utf8.RuneCountInString(s[:i])
+		end := start + utf8.RuneCountInString(s[i:i+j+1])
+		ps = append(ps, placeholder{name: s[i+2 : i+j], start: start, end: end})
+		col = end
+		s = s[i+j+1:]
+	}
+}
+
+// expandVars replaces the placeholders in s that have a value in vars.
+func expandVars(s string, vars map[string]string) string {
+	if vars == nil {
+		return s
+	}
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		sb.WriteString(s[:i])
+		if val, ok := vars[s[i+2:i+j]]; ok {
+			sb.WriteString(val)
+		} else {
+			sb.WriteString(s[i : i+j+1])
+		}
+		s = s[i+j+1:]
+	}
+	sb.WriteString(s)
 	return sb.String()
 }
 
@@ -93,11 +387,41 @@ type Mask struct {
 	start, len int
 	match      string
 	checks     []SegChecker
+	capture    bool
+	time       *timeSpec
+	fold       bool
 }
 
+func (s *Mask) Name() rune { return s.name }
 func (s *Mask) Start() int { return s.start }
 func (s *Mask) Len() int   { return s.len }
 
+// Capture reports if the mask binds its value on the first match. Later
+// matches of capturing masks with the same name must have the same value.
+func (s *Mask) Capture() bool { return s.capture }
+
+// Timestamp reports if the mask is a timestamp. If so, layout is the Go time
+// layout of the masked text and order is the order of the timestamps.
+func (s *Mask) Timestamp() (layout string, order TimeOrder, ok bool) {
+	if s.time == nil {
+		return "", OrderNone, false
+	}
+	return s.time.layout, s.time.order, true
+}
+
+// FoldCase reports if the mask matches case-insensitive.
+func (s *Mask) FoldCase() bool { return s.fold }
+
+func cloneMasks(ms []*Mask) []*Mask {
+	res := make([]*Mask, len(ms))
+	for i, m := range ms {
+		c := *m
+		c.checks = slices.Clip(c.checks)
+		res[i] = &c
+	}
+	return res
+}
+
 func (s *Mask) empty() bool { return s.len == 0 }
 
 func (s *Mask) end() int { return s.start + s.len }
@@ -123,6 +447,9 @@ func (s *Mask) writeRegexp(w io.Writer) {
 	if s.match != "" {
 		class = s.match
 	}
+	if s.fold {
+		class = "(?i:" + class + ")"
+	}
 	switch s.typ {
 	case maskFix:
 		fmt.Fprintf(w, "(%s{%d})", class, s.len)
@@ -137,12 +464,25 @@ func (s *Mask) writeRegexp(w io.Writer) {
 	case maskAtLeast:
 		fmt.Fprintf(w, "(%s{%d,})", class, s.len)
 	case maskMatch:
-		fmt.Fprintf(w, "(%s)", s.match)
+		fmt.Fprintf(w, "(%s)", class)
 	default:
 		panic(fmt.Sprintf("Mask.writeRegexp(): illegal typ %d", s.typ))
 	}
 }
 
+// groups returns the number of capturing groups in the regular expression
+// of s.
+func (s *Mask) groups() int {
+	if s.match == "" {
+		return 0
+	}
+	re, err := syntax.Parse(s.match, syntax.Perl)
+	if err != nil {
+		return 0 // Compiling the reference line fails
+	}
+	return re.MaxCap()
+}
+
 func (s *Mask) String() string {
 	var sb strings.Builder
 	fmt.Fprintf(&sb, "[%c:%d+%d", s.name, s.start, s.len)
@@ -155,6 +495,9 @@ func (s *Mask) String() string {
 
 func segCmpr(s, t *Mask) int { return s.start - t.start }
 
+// A SegChecker checks the subject text of a mask after the reference line
+// matched. The check fails if Check returns an error. Checkers are attached
+// to masks with argument lines of type '!', see RegisterChecker.
 type SegChecker interface {
 	Check(seg []byte) error
 }
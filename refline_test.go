@@ -17,12 +17,12 @@ func Test_refLine(t *testing.T) {
 	x := RefLine{
 		text: "Dec 15 22:34:38 machine systemd[1]: Starting Network Manager Script Dispatcher Service...",
 	}
-	testerr.Shall(x.addMask(&Mask{'M', maskFix, 0, 3, ``, nil})).BeNil(t)
-	testerr.Shall(x.addMask(&Mask{'D', mask1UpTo, 4, 2, `\d`, nil})).BeNil(t)
-	testerr.Shall(x.addMask(&Mask{'h', maskFix, 7, 2, ``, nil})).BeNil(t)
-	testerr.Shall(x.addMask(&Mask{'m', maskFix, 10, 2, ``, nil})).BeNil(t)
-	testerr.Shall(x.addMask(&Mask{'s', maskFix, 13, 2, ``, nil})).BeNil(t)
-	rgxStr := x.regexp()
+	testerr.Shall(x.addMask(&Mask{name: 'M', typ: maskFix, start: 0, len: 3})).BeNil(t)
+	testerr.Shall(x.addMask(&Mask{name: 'D', typ: mask1UpTo, start: 4, len: 2, match: `\d`})).BeNil(t)
+	testerr.Shall(x.addMask(&Mask{name: 'h', typ: maskFix, start: 7, len: 2})).BeNil(t)
+	testerr.Shall(x.addMask(&Mask{name: 'm', typ: maskFix, start: 10, len: 2})).BeNil(t)
+	testerr.Shall(x.addMask(&Mask{name: 's', typ: maskFix, start: 13, len: 2})).BeNil(t)
+	rgxStr := x.regexp(nil)
 	fmt.Printf("`%s`\n", rgxStr)
 	rgx := regexp.MustCompile(rgxStr)
 	if match := rgx.FindStringSubmatch(x.text); match == nil {
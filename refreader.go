@@ -1,40 +1,85 @@
 package texst
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
 type RefReader struct {
-	src    string
-	rd     io.Reader
-	scn    *bufio.Scanner
-	ll     []byte
-	lno    int
-	ilgs   []rune
-	globLT *lineTemplate
+	refSource
+	incl    []refSource // Sources that include the current source
+	ll      []byte
+	ilgs    []rune
+	igNames map[string]rune // Declared names of interleaving groups
+	globLT  *lineTemplate
+	igMasks map[rune]*groupMasks // Global mask templates of groups
+	pre     Preamble
+	synced  map[string][]rune // Groups with a barrier line per barrier
+	labels  map[string]bool   // Labels of reference lines
+	after   []labelRef        // Uses of labels
+	body    bool              // Preamble is done
+	vars    map[string]string
+	space   SpaceMode
+	fold    bool
+	tmpls   map[string]*lineTemplate // Named mask templates
+	maxLen  int                      // Maximum line length, <= 0 is unlimited
 
 	rlPool *RefLine
 }
 
-func NewRefReader(name string, r io.Reader) (*RefReader, error) {
+type refSource struct {
+	src string
+	rd  io.Reader
+	scn *lineScanner
+	lno int
+}
+
+// A RefOption configures a RefReader.
+type RefOption func(*RefReader)
+
+// WithVars sets the values of the placeholders ${NAME} in reference texts.
+// The values are matched literally. Without WithVars placeholders are plain
+// reference text.
+func WithVars(vars map[string]string) RefOption {
+	return func(rr *RefReader) {
+		rr.vars = maps.Clone(vars)
+		if rr.vars == nil {
+			rr.vars = make(map[string]string)
+		}
+	}
+}
+
+// WithMaxLineLen limits the length of reference lines to max bytes. Longer
+// lines are an error. By default the line length is not limited.
+func WithMaxLineLen(max int) RefOption {
+	return func(rr *RefReader) { rr.maxLen = max }
+}
+
+func NewRefReader(name string, r io.Reader, opts ...RefOption) (*RefReader, error) {
 	if r == nil {
 		return nil, errors.New("nil reader")
 	}
 	rr := &RefReader{
-		src: name,
-		rd:  r,
-		scn: bufio.NewScanner(r),
+		refSource: refSource{
+			src: name,
+			rd:  r,
+		},
 	}
+	for _, opt := range opts {
+		opt(rr)
+	}
+	rr.scn = newLineScanner(r, rr.maxLen)
 	if err := rr.preamble(); err != nil {
 		if errors.Is(err, io.EOF) {
 			return nil, lineErrorf(rr, "no reference line after preamble")
@@ -44,68 +89,574 @@ func NewRefReader(name string, r io.Reader) (*RefReader, error) {
 	if len(rr.ilgs) == 0 {
 		rr.ilgs = []rune{' '}
 	}
+	if rr.pre.Encoding == "" {
+		rr.pre.Encoding = EncUTF8
+	}
+	for _, fl := range rr.pre.Forbidden {
+		if err := rr.checkIGroup(fl); err != nil {
+			return nil, err
+		}
+	}
+	for _, gt := range rr.pre.GroupTemplates {
+		if !slices.Contains(rr.ilgs, gt.igName) {
+			return nil, fmt.Errorf("%s:%d:group template of undeclared interleaving group '%s'",
+				gt.srcName,
+				gt.srcLine,
+				gt.IGroupName(),
+			)
+		}
+	}
+	for _, b := range rr.pre.Barriers {
+		for i, ig := range b.groups {
+			if !slices.Contains(rr.ilgs, ig) {
+				return nil, fmt.Errorf("%s:%d:barrier '%s' of undeclared interleaving group '%s'",
+					b.srcName,
+					b.srcLine,
+					b.name,
+					b.labels[i],
+				)
+			}
+			if rr.groupTemplate(ig) != nil {
+				return nil, fmt.Errorf("%s:%d:barrier '%s' of group template '%s'",
+					b.srcName,
+					b.srcLine,
+					b.name,
+					b.labels[i],
+				)
+			}
+		}
+	}
+	rr.body = true
 	return rr, nil
 }
 
-func NewRefString(name, texts string) (*RefReader, error) {
-	return NewRefReader(name, strings.NewReader(texts))
+func NewRefString(name, texts string, opts ...RefOption) (*RefReader, error) {
+	return NewRefReader(name, strings.NewReader(texts), opts...)
 }
 
-func OpenRefFile(file string) (*RefReader, error) {
+func OpenRefFile(file string, opts ...RefOption) (*RefReader, error) {
 	r, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
-	return NewRefReader(file, r)
+	return NewRefReader(file, r, opts...)
 }
 
 func (rr *RefReader) Close() error {
+	var errs []error
+	for len(rr.incl) > 0 {
+		errs = append(errs, rr.endInclude())
+	}
 	rr.scn = nil
 	if c, ok := rr.rd.(io.Closer); ok {
-		return c.Close()
+		errs = append(errs, c.Close())
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
+// Name returns the name of the current source of reference lines. This is
+// the name of an included file while reading included lines.
 func (rr *RefReader) Name() string { return rr.src }
 
+// Line returns the line number in the current source of reference lines.
 func (rr *RefReader) Line() int { return rr.lno }
 
 func (rr *RefReader) IGroups() []rune { return rr.ilgs }
 
 func (rr *RefReader) NextLine() (*RefLine, error) {
 	if rr.ll == nil {
-		if err := rr.scan(); err != nil {
+		if err := rr.scan(); errors.Is(err, io.EOF) {
+			if err := rr.checkAfter(); err != nil {
+				return nil, err
+			}
+			return nil, lineError(rr, err)
+		} else if err != nil {
 			return nil, lineError(rr, err)
 		}
 	}
+	if err := rr.globalArgLines(); errors.Is(err, io.EOF) {
+		if err := rr.checkAfter(); err != nil {
+			return nil, err
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(rr.ll, []byte(SkipLine)):
+		return rr.skipLine()
+	case rr.ll[0] == TagBlockStart:
+		return rr.block(blockLine, TagBlockEnd)
+	case rr.ll[0] == TagSetStart:
+		return rr.block(setLine, TagSetEnd)
+	case rr.ll[0] == TagBarrier:
+		return rr.barrierLine()
+	}
 	c0, c1, line, err := rr.tokenize()
 	if err != nil {
 		return nil, lineError(rr, err)
 	}
-	if c0 != TagRefLine {
-		return nil, lineErrorf(rr,
-			"expect reference line marker '%c', have '%c'",
-			TagRefLine,
-			c0,
-		)
+	switch c0 {
+	case TagRefLine, TagOptRefLine:
+		return rr.textLine(c0, c1, line)
+	case TagForbidden:
+		return nil, lineErrorf(rr, "forbidden line outside of preamble and blocks")
+	}
+	return nil, lineErrorf(rr,
+		"expect reference line marker '%c', have '%c'",
+		TagRefLine,
+		c0,
+	)
+}
+
+// Preamble returns the declarations from the preamble.
+func (rr *RefReader) Preamble() *Preamble { return &rr.pre }
+
+// forbiddenLine reads the forbidden line at the current line.
+func (rr *RefReader) forbiddenLine() (*RefLine, error) {
+	_, c1, line, err := rr.tokenize()
+	if err != nil {
+		return nil, lineError(rr, err)
 	}
+	fl, err := rr.textLine(TagForbidden, c1, line)
+	if err != nil {
+		return nil, err
+	}
+	return fl, rr.checkIGroup(fl)
+}
+
+// checkIGroup returns an error if the interleaving group of rl is not
+// declared.
+func (rr *RefReader) checkIGroup(rl *RefLine) error {
+	if slices.Contains(rr.ilgs, rl.igName) {
+		return nil
+	}
+	return fmt.Errorf("%s:%d:undeclared interleaving group '%s'",
+		rl.srcName,
+		rl.srcLine,
+		rl.IGroupName(),
+	)
+}
+
+// groupMasks is the global mask template of an interleaving group. Unless
+// only is set, it applies in addition to the document-wide template.
+type groupMasks struct {
+	lineTemplate
+	only bool
+}
+
+// masksDirective parses the argument "<group> <template> [only]" of a
+// DirMasks directive. The template NoTemplate removes the group's template.
+func (rr *RefReader) masksDirective(arg string) error {
+	fs := strings.Fields(arg)
+	if len(fs) < 2 || len(fs) > 3 || (len(fs) == 3 && fs[2] != "only") {
+		return fmt.Errorf("masks: expect group, mask template and optional 'only', have '%s'", arg)
+	}
+	ig, sz := utf8.DecodeRuneInString(fs[0])
+	ig, rest, err := rr.namedIGroup(ig, []byte(fs[0][sz:]))
+	if err != nil {
+		return fmt.Errorf("masks: %w", err)
+	}
+	if len(rest) > 0 || !slices.Contains(rr.ilgs, ig) {
+		return fmt.Errorf("masks: undeclared interleaving group '%s'", fs[0])
+	}
+	if fs[1] == NoTemplate {
+		delete(rr.igMasks, ig)
+		return nil
+	}
+	lt := rr.tmpls[fs[1]]
+	if lt == nil {
+		return fmt.Errorf("masks: no mask template '%s'", fs[1])
+	}
+	if rr.igMasks == nil {
+		rr.igMasks = make(map[rune]*groupMasks)
+	}
+	rr.igMasks[ig] = &groupMasks{
+		lineTemplate: lineTemplate{
+			srcName: rr.Name(),
+			srcLine: rr.Line(),
+			masks:   cloneMasks(lt.masks),
+		},
+		only: len(fs) == 3,
+	}
+	return nil
+}
+
+// textLine reads a reference line, an optional reference line or a forbidden
+// line depending on the tag c0, including its argument lines. Forbidden lines
+// do not use the global mask template.
+func (rr *RefReader) textLine(c0, c1 rune, line []byte) (*RefLine, error) {
+	pad := utf8.RuneCount(line)
+	c1, line, err := rr.namedIGroup(c1, line)
+	if err != nil {
+		return nil, lineError(rr, err)
+	}
+	pad -= utf8.RuneCount(line)
 	rr.ll = nil
 	rl := rr.newLine(c1, string(line))
-	if rr.globLT != nil {
-		rl.masks = slices.Clone(rr.globLT.masks)
+	var glob []*Mask
+	if c0 != TagForbidden {
+		gm := rr.igMasks[c1]
+		if rr.globLT != nil && (gm == nil || !gm.only) {
+			rl.masks = cloneMasks(rr.globLT.masks)
+		}
+		if gm != nil {
+			for _, m := range cloneMasks(gm.masks) {
+				if err = rl.addMask(m); err != nil {
+					return nil, lineErrorf(rr, "group mask template: %s", err)
+				}
+			}
+		}
+		glob = slices.Clone(rl.masks)
+	}
+	err = rr.argLines(rl, glob, pad)
+	for err == nil && rr.ll[0] == TagContinue {
+		err = rr.continuation(rl)
 	}
-	err = rr.argLines(&rl.lineTemplate)
 	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, err
 	}
-	if rl.rgx, err = regexp.Compile(rl.regexp()); err != nil {
+	switch c0 {
+	case TagOptRefLine:
+		rl.min = 0
+	case TagForbidden:
+		rl.kind = forbidLine
+	}
+	if l := len(rl.masks); l > 0 && rl.masks[l-1].end() > utf8.RuneCountInString(rl.text) {
+		return nil, lineErrorf(rr,
+			"mask %s exceeds reference text",
+			rl.masks[l-1],
+		)
+	}
+	if c0 != TagForbidden {
+		if gt := rr.groupTemplate(rl.igName); gt != nil && !rl.hasKey(gt.key) {
+			return nil, lineErrorf(rr,
+				"line of group template '%s' has no key mask '%c'",
+				gt.IGroupName(),
+				gt.key,
+			)
+		}
+	}
+	if rr.vars != nil {
+		if err = rr.checkVars(rl); err != nil {
+			return nil, err
+		}
+	}
+	if rl.bytes {
+		if err = rl.checkBytes(); err != nil {
+			return nil, lineError(rr, err)
+		}
+	}
+	if rl.rgx, err = regexp.Compile(rl.regexp(rr.vars)); err != nil {
 		return nil, lineError(rr, err)
 	}
 	return rl, nil
 }
 
+// continuation appends the continuation line at the current line and the
+// masks from its argument lines to rl.
+func (rr *RefReader) continuation(rl *RefLine) error {
+	if rr.pre.Continuation == nil {
+		return lineErrorf(rr, "continuation line without %c%s directive", TagDirective, DirContinue)
+	}
+	_, ig, rest, err := rr.tokenize()
+	pad := utf8.RuneCount(rest)
+	if err == nil {
+		ig, rest, err = rr.namedIGroup(ig, rest)
+	}
+	if err != nil {
+		return lineError(rr, err)
+	}
+	pad -= utf8.RuneCount(rest)
+	line := string(rest) // Scanning argument lines reuses the line buffer
+	if ig != rl.igName {
+		return lineErrorf(rr,
+			"continuation line of interleaving group '%s' for group '%s'",
+			rr.igLabel(ig),
+			rl.IGroupName(),
+		)
+	}
+	rr.ll = nil
+	var lt lineTemplate
+	for {
+		if err = rr.scan(); err != nil {
+			err = lineError(rr, err)
+			break
+		}
+		if rr.ll[0] != TagRefLineArg {
+			break
+		}
+		_, c1, args, err := rr.tokenize()
+		if err != nil {
+			return lineError(rr, err)
+		}
+		rr.ll = nil
+		if args, err = alignMasks(c1, args, pad); err == nil {
+			err = rr.maskArg(&lt, c1, args)
+		}
+		if err != nil {
+			return fmt.Errorf("arg line: %w", err)
+		}
+	}
+	if l := len(lt.masks); l > 0 && lt.masks[l-1].end() > utf8.RuneCountInString(line) {
+		return lineErrorf(rr, "mask %s exceeds continuation text", lt.masks[l-1])
+	}
+	offset := utf8.RuneCountInString(rl.text) + 1
+	rl.text += "\n" + line
+	for _, m := range lt.masks {
+		m.start += offset
+		if merr := rl.addMask(m); merr != nil {
+			return lineError(rr, merr)
+		}
+	}
+	return err
+}
+
+// checkVars checks that all placeholders in the text of rl have a value and
+// do not overlap with masks.
+func (rr *RefReader) checkVars(rl *RefLine) error {
+	for _, p := range placeholders(rl.text) {
+		if _, ok := rr.vars[p.name]; !ok {
+			return lineErrorf(rr, "undefined variable '%s'", p.name)
+		}
+		for _, m := range rl.masks {
+			if m.start < p.end && m.end() > p.start {
+				return lineErrorf(rr, "mask %s overlaps variable '%s'", m, p.name)
+			}
+		}
+	}
+	return nil
+}
+
+func (rr *RefReader) skipLine() (*RefLine, error) {
+	line := rr.ll[len(SkipLine):]
+	ig := ' '
+	if len(line) > 0 {
+		var sz int
+		ig, sz = utf8.DecodeRune(line)
+		if ig == utf8.RuneError {
+			return nil, lineErrorf(rr, "invalid UTF-8 encoding in skip line")
+		}
+		var err error
+		if ig, line, err = rr.namedIGroup(ig, line[sz:]); err != nil {
+			return nil, lineError(rr, err)
+		}
+	}
+	min, max, err := parseSkip(string(bytes.TrimSpace(line)))
+	if err != nil {
+		return nil, lineError(rr, err)
+	}
+	rr.ll = nil
+	rl := rr.newLine(ig, "")
+	rl.kind = skipLine
+	rl.min, rl.max = min, max
+	return rl, nil
+}
+
+// barrierLine reads the barrier line "|<group> <barrier>" at the current
+// line. Each participating group of a barrier has exactly one barrier line.
+func (rr *RefReader) barrierLine() (*RefLine, error) {
+	_, ig, line, err := rr.tokenize()
+	if err != nil {
+		return nil, lineError(rr, err)
+	}
+	if ig, line, err = rr.namedIGroup(ig, line); err != nil {
+		return nil, lineError(rr, err)
+	}
+	name := string(bytes.TrimSpace(line))
+	i := slices.IndexFunc(rr.pre.Barriers, func(b *Barrier) bool { return b.name == name })
+	if i < 0 {
+		return nil, lineErrorf(rr, "undeclared barrier '%s'", name)
+	}
+	if !slices.Contains(rr.pre.Barriers[i].groups, ig) {
+		return nil, lineErrorf(rr,
+			"interleaving group '%s' does not participate in barrier '%s'",
+			rr.igLabel(ig),
+			name,
+		)
+	}
+	if slices.Contains(rr.synced[name], ig) {
+		return nil, lineErrorf(rr,
+			"interleaving group '%s' has more than one line of barrier '%s'",
+			rr.igLabel(ig),
+			name,
+		)
+	}
+	if rr.synced == nil {
+		rr.synced = make(map[string][]rune)
+	}
+	rr.synced[name] = append(rr.synced[name], ig)
+	rr.ll = nil
+	rl := rr.newLine(ig, name)
+	rl.kind = barrierLine
+	rl.min, rl.max = 0, 0
+	return rl, nil
+}
+
+func (rr *RefReader) block(kind lineKind, end byte) (*RefLine, error) {
+	ig := ' '
+	if line := rr.ll[1:]; len(line) > 0 {
+		var sz int
+		ig, sz = utf8.DecodeRune(line)
+		if ig == utf8.RuneError {
+			return nil, lineErrorf(rr, "invalid UTF-8 encoding in block line")
+		}
+		var err error
+		if ig, line, err = rr.namedIGroup(ig, line[sz:]); err != nil {
+			return nil, lineError(rr, err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return nil, lineErrorf(rr, "unexpected text after block start")
+		}
+	}
+	blk := rr.newLine(ig, "")
+	blk.kind = kind
+	rr.ll = nil
+	var lines refLineQ
+	for {
+		if rr.ll == nil {
+			if err := rr.scan(); errors.Is(err, io.EOF) {
+				return nil, lineErrorf(rr,
+					"missing end of block from line %d",
+					blk.SourceLine(),
+				)
+			} else if err != nil {
+				return nil, lineError(rr, err)
+			}
+		}
+		if err := rr.globalArgLines(); errors.Is(err, io.EOF) {
+			return nil, lineErrorf(rr,
+				"missing end of block from line %d",
+				blk.SourceLine(),
+			)
+		} else if err != nil {
+			return nil, err
+		}
+		if rr.ll[0] == end {
+			break
+		}
+		if rr.ll[0] == TagForbidden {
+			fl, err := rr.forbiddenLine()
+			if err != nil {
+				return nil, err
+			}
+			if fl.igName != ig {
+				return nil, lineErrorf(rr,
+					"forbidden line of interleaving group '%s' in block of group '%s'",
+					fl.IGroupName(),
+					blk.IGroupName(),
+				)
+			}
+			blk.forbid = append(blk.forbid, fl)
+			continue
+		}
+		rl, err := rr.NextLine()
+		if err != nil {
+			return nil, err
+		}
+		if rl.kind == barrierLine {
+			return nil, lineErrorf(rr,
+				"barrier line in block from line %d",
+				blk.SourceLine(),
+			)
+		}
+		if kind == setLine && rl.kind != textLine {
+			return nil, lineErrorf(rr,
+				"unordered block from line %d must only have reference lines",
+				blk.SourceLine(),
+			)
+		}
+		if rl.igName != ig {
+			return nil, lineErrorf(rr,
+				"line of interleaving group '%s' in block of group '%s'",
+				rl.IGroupName(),
+				blk.IGroupName(),
+			)
+		}
+		lines.pushBack(rl)
+	}
+	if lines.empty() {
+		return nil, lineErrorf(rr, "empty block")
+	}
+	blk.sub = lines.first
+	if rep := bytes.TrimSpace(rr.ll[1:]); len(rep) > 0 {
+		var err error
+		if blk.min, blk.max, err = parseRepeat(string(rep)); err != nil {
+			return nil, lineError(rr, err)
+		}
+	}
+	rr.ll = nil
+	return blk, nil
+}
+
+// parseRepeat parses a repetition quantifier "{N}", "{N,}" or "{N,M}".
+func parseRepeat(s string) (min, max int, err error) {
+	q, ok := strings.CutPrefix(s, "{")
+	if ok {
+		q, ok = strings.CutSuffix(q, "}")
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("illegal repetition '%s'", s)
+	}
+	lo, hi, isRange := strings.Cut(q, ",")
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, fmt.Errorf("illegal repetition '%s'", s)
+	}
+	switch {
+	case !isRange:
+		max = min
+	case hi == "":
+		max = -1
+	default:
+		if max, err = strconv.Atoi(hi); err != nil {
+			return 0, 0, fmt.Errorf("illegal repetition '%s'", s)
+		}
+	}
+	if min < 0 || max == 0 || (max > 0 && max < min) {
+		return 0, 0, fmt.Errorf("illegal repetition range '%s'", s)
+	}
+	return min, max, nil
+}
+
+// parseSkip parses the count of a skip line: "" is the same as "1", "N" skips
+// exactly N lines, "N..M" skips N up to M lines, "N.." skips at least N lines
+// and "*" is the same as "0..".
+func parseSkip(s string) (min, max int, err error) {
+	switch s {
+	case "":
+		return 1, 1, nil
+	case "*":
+		return 0, -1, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "..")
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, fmt.Errorf("illegal skip count '%s'", s)
+	}
+	switch {
+	case !isRange:
+		max = min
+	case hi == "":
+		max = -1
+	default:
+		if max, err = strconv.Atoi(hi); err != nil {
+			return 0, 0, fmt.Errorf("illegal skip count '%s'", s)
+		}
+	}
+	if min < 0 || (max >= 0 && max < min) {
+		return 0, 0, fmt.Errorf("illegal skip range '%s'", s)
+	}
+	return min, max, nil
+}
+
 func (rr *RefReader) FreeLine(rl *RefLine) {
+	for sub := rl.sub; sub != nil; {
+		next := sub.lsNext
+		rr.FreeLine(sub)
+		sub = next
+	}
+	for _, fl := range rl.forbid {
+		rr.FreeLine(fl)
+	}
 	*rl = RefLine{}
 	rl.lsNext = rr.rlPool
 	rr.rlPool = rl
@@ -113,55 +664,341 @@ func (rr *RefReader) FreeLine(rl *RefLine) {
 
 func (rr *RefReader) newLine(ig rune, txt string) (rl *RefLine) {
 	if rr.rlPool == nil {
-		rl = &RefLine{
-			lineTemplate: lineTemplate{
-				srcName: rr.Name(),
-				srcLine: rr.Line(),
-			},
-			igName: ig,
-			text:   txt,
-		}
+		rl = new(RefLine)
 	} else {
 		rl = rr.rlPool
 		rr.rlPool = rl.lsNext
-		rl.srcName = rr.Name()
-		rl.srcLine = rr.Line()
-		rl.igName = ig
-		rl.text = txt
-		rl.lsNext = nil
+	}
+	*rl = RefLine{
+		lineTemplate: lineTemplate{
+			srcName: rr.Name(),
+			srcLine: rr.Line(),
+		},
+		igName:  ig,
+		igLabel: rr.igLabel(ig),
+		text:    txt,
+		space:   rr.space,
+		fold:    rr.fold,
+		bytes:   rr.pre.Encoding == EncBytes,
+		min:     1,
+		max:     1,
 	}
 	return rl
 }
 
-func (rr *RefReader) argLines(rl *lineTemplate) error {
+// argLines reads the argument lines of rl. The masks glob are the masks of rl
+// that were cloned from the global mask template.
+// argLines reads the argument lines of rl. The reference text of rl starts
+// pad columns further right than usual because of a group name in braces.
+func (rr *RefReader) argLines(rl *RefLine, glob []*Mask, pad int) error {
 	for {
 		if err := rr.scan(); err != nil {
-			return err
+			return lineError(rr, err)
 		}
-		c0, c1, line, err := rr.tokenize()
+		if rr.ll[0] != TagRefLineArg {
+			break
+		}
+		_, c1, line, err := rr.tokenize()
 		if err != nil {
 			return err
 		}
-		if c0 != TagRefLineArg {
-			break
-		}
 		rr.ll = nil
-		segType, err := parseMaskType(c1)
-		if err != nil {
-			return fmt.Errorf("arg line: %w", err)
+		if c1 == ArgRepeat {
+			if rl.min, rl.max, err = parseRepeat("{" + string(line)); err != nil {
+				return lineError(rr, err)
+			}
+			continue
 		}
-		switch segType {
-		case maskMatch:
-			if err = rr.match(rl, line); err != nil {
-				return err
+		switch c1 {
+		case ArgTimeMark:
+			err = rr.timeMark(rl, line)
+		case ArgTimeGap:
+			err = rr.timeGap(rl, line)
+		case ArgTemplate:
+			err = rr.useTemplate(rl, glob, line)
+		case ArgFoldCase:
+			if len(bytes.TrimSpace(line)) == 0 {
+				rl.fold = true
+			} else {
+				err = rr.maskArg(&rl.lineTemplate, c1, line)
 			}
-		case maskClass:
-			if err = rr.class(rl, line); err != nil {
-				return err
+		case ArgSpace:
+			if rl.space, err = ParseSpaceMode(string(line)); err != nil {
+				err = lineError(rr, err)
+			}
+		case ArgLabel:
+			err = rr.label(rl, line)
+		case ArgAfter:
+			labels := strings.Fields(string(line))
+			if len(labels) == 0 {
+				err = lineErrorf(rr, "missing labels")
 			}
+			for _, l := range labels {
+				rr.after = append(rr.after, labelRef{label: l, srcName: rr.Name(), srcLine: rr.Line()})
+			}
+			rl.after = append(rl.after, labels...)
 		default:
-			if err = rr.masks(rl, segType, line); err != nil {
-				return err
+			if line, err = alignMasks(c1, line, pad); err == nil {
+				err = rr.maskArg(&rl.lineTemplate, c1, line)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("arg line: %w", err)
+		}
+	}
+	return nil
+}
+
+// alignMasks drops the first pad columns of the mask line of type c1 so that
+// its columns line up with a reference text that starts pad columns further
+// right than usual. The dropped columns must be blank.
+func alignMasks(c1 rune, line []byte, pad int) ([]byte, error) {
+	if pad == 0 {
+		return line, nil
+	}
+	if st, err := parseMaskType(c1); err != nil || st == maskMatch || st == maskClass {
+		return line, nil
+	}
+	for i := 0; i < pad && len(line) > 0; i++ {
+		r, sz := utf8.DecodeRune(line)
+		if r != ' ' {
+			return nil, fmt.Errorf("mask '%c' in front of reference text", r)
+		}
+		line = line[sz:]
+	}
+	return line, nil
+}
+
+// labelRef is the use of a label in an argument line of type ArgAfter.
+type labelRef struct {
+	label   string
+	srcName string
+	srcLine int
+}
+
+// checkAfter returns an error if an argument line of type ArgAfter uses a
+// label that no reference line has. It is called at the end of the reference.
+func (rr *RefReader) checkAfter() error {
+	for _, ref := range rr.after {
+		if !rr.labels[ref.label] {
+			return fmt.Errorf("%s:%d:undefined label '%s'",
+				ref.srcName,
+				ref.srcLine,
+				ref.label,
+			)
+		}
+	}
+	return nil
+}
+
+// label sets the label of rl from an argument line of type ArgLabel. Labels
+// must be unique.
+func (rr *RefReader) label(rl *RefLine, line []byte) error {
+	l := string(bytes.TrimSpace(line))
+	switch {
+	case l == "" || strings.ContainsFunc(l, unicode.IsSpace):
+		return lineErrorf(rr, "illegal label '%s'", l)
+	case rl.label != "":
+		return lineErrorf(rr, "reference line has label '%s'", rl.label)
+	case rr.labels[l]:
+		return lineErrorf(rr, "redefining label '%s'", l)
+	}
+	if rr.labels == nil {
+		rr.labels = make(map[string]bool)
+	}
+	rr.labels[l] = true
+	rl.label = l
+	return nil
+}
+
+// maskArg applies a mask argument line of type c1 to the masks of lt.
+func (rr *RefReader) maskArg(lt *lineTemplate, c1 rune, line []byte) error {
+	switch c1 {
+	case ArgCapture:
+		return rr.capture(lt, line)
+	case ArgCheck:
+		return rr.check(lt, line)
+	case ArgTime:
+		return rr.timestamp(lt, line)
+	case ArgFoldCase:
+		return rr.foldCase(lt, line)
+	}
+	segType, err := parseMaskType(c1)
+	if err != nil {
+		return err
+	}
+	switch segType {
+	case maskMatch:
+		return rr.match(lt, line)
+	case maskClass:
+		return rr.class(lt, line)
+	}
+	return rr.masks(lt, segType, line)
+}
+
+func (rr *RefReader) check(rl *lineTemplate, line []byte) error {
+	nm, sz := utf8.DecodeRune(line)
+	if nm == utf8.RuneError {
+		return lineErrorf(rr, "rune error for mask name")
+	}
+	name, args, _ := strings.Cut(strings.TrimSpace(string(line[sz:])), " ")
+	chk, err := NewChecker(name, strings.TrimSpace(args))
+	if err != nil {
+		return lineError(rr, err)
+	}
+	found := false
+	for _, seg := range rl.masks {
+		if seg.name == nm {
+			seg.checks = append(seg.checks, chk)
+			found = true
+		}
+	}
+	if !found {
+		return lineErrorf(rr, "no mask '%c' to check", nm)
+	}
+	return nil
+}
+
+// useTemplate adds the masks of the named mask template to rl. The name "-"
+// removes the masks glob of the global mask template from rl.
+func (rr *RefReader) useTemplate(rl *RefLine, glob []*Mask, line []byte) error {
+	name := strings.TrimSpace(string(line))
+	if name == NoTemplate {
+		rl.masks = slices.DeleteFunc(rl.masks, func(m *Mask) bool {
+			return slices.Contains(glob, m)
+		})
+		return nil
+	}
+	lt := rr.tmpls[name]
+	if lt == nil {
+		return lineErrorf(rr, "no mask template '%s'", name)
+	}
+	for _, m := range cloneMasks(lt.masks) {
+		if err := rl.addMask(m); err != nil {
+			return lineErrorf(rr, "mask template '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+// templateName splits the name of a named mask template from a global
+// argument line. The name starts with c1 that must be a letter and continues
+// with letters and digits. The rune after the name is the argument type.
+func templateName(c1 rune, line []byte) (name string, typ rune, rest []byte, err error) {
+	var sb strings.Builder
+	sb.WriteRune(c1)
+	for {
+		r, sz := utf8.DecodeRune(line)
+		switch {
+		case r == utf8.RuneError:
+			return "", 0, line, fmt.Errorf("incomplete mask template '%s'", sb.String())
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			sb.WriteRune(r)
+			line = line[sz:]
+		default:
+			return sb.String(), r, line[sz:], nil
+		}
+	}
+}
+
+func (rr *RefReader) timestamp(rl *lineTemplate, line []byte) error {
+	nm, sz := utf8.DecodeRune(line)
+	if nm == utf8.RuneError {
+		return lineErrorf(rr, "rune error for mask name")
+	}
+	ts, err := parseTimeSpec(strings.TrimSpace(string(line[sz:])))
+	if err != nil {
+		return lineError(rr, err)
+	}
+	found := false
+	for _, seg := range rl.masks {
+		if seg.name == nm {
+			seg.time = ts
+			found = true
+		}
+	}
+	if !found {
+		return lineErrorf(rr, "no mask '%c' for timestamp", nm)
+	}
+	return nil
+}
+
+// timeMask returns the name of the timestamp mask at the start of line and
+// the rest of the line.
+func (rr *RefReader) timeMask(rl *RefLine, line []byte) (rune, string, error) {
+	nm, sz := utf8.DecodeRune(line)
+	if nm == utf8.RuneError {
+		return nm, "", lineErrorf(rr, "rune error for mask name")
+	}
+	for _, seg := range rl.masks {
+		if seg.name == nm && seg.time != nil {
+			return nm, strings.TrimSpace(string(line[sz:])), nil
+		}
+	}
+	return nm, "", lineErrorf(rr, "no timestamp mask '%c'", nm)
+}
+
+func (rr *RefReader) timeMark(rl *RefLine, line []byte) error {
+	nm, label, err := rr.timeMask(rl, line)
+	if err != nil {
+		return err
+	}
+	if label == "" || strings.ContainsRune(label, ' ') {
+		return lineErrorf(rr, "illegal time mark '%s'", label)
+	}
+	rl.marks = append(rl.marks, timeMark{mask: nm, label: label})
+	return nil
+}
+
+func (rr *RefReader) timeGap(rl *RefLine, line []byte) error {
+	nm, arg, err := rr.timeMask(rl, line)
+	if err != nil {
+		return err
+	}
+	gap, err := parseTimeGap(nm, arg)
+	if err != nil {
+		return lineError(rr, err)
+	}
+	rl.gaps = append(rl.gaps, gap)
+	return nil
+}
+
+func (rr *RefReader) foldCase(rl *lineTemplate, line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return lineErrorf(rr, "missing mask names to fold case")
+	}
+	for len(line) > 0 {
+		nm, sz := utf8.DecodeRune(line)
+		if nm == utf8.RuneError {
+			return lineErrorf(rr, "rune error for mask name")
+		}
+		line = line[sz:]
+		if unicode.IsSpace(nm) {
+			continue
+		}
+		for _, seg := range rl.masks {
+			if seg.name == nm {
+				seg.fold = true
+			}
+		}
+	}
+	return nil
+}
+
+func (rr *RefReader) capture(rl *lineTemplate, line []byte) error {
+	for len(line) > 0 {
+		nm, sz := utf8.DecodeRune(line)
+		if nm == utf8.RuneError {
+			return lineErrorf(rr, "rune error for mask name")
+		}
+		line = line[sz:]
+		if unicode.IsSpace(nm) {
+			continue
+		}
+		for _, seg := range rl.masks {
+			if seg.name == nm {
+				seg.capture = true
 			}
 		}
 	}
@@ -252,58 +1089,108 @@ func (rr *RefReader) masks(rl *lineTemplate, st maskType, l []byte) error {
 	return nil
 }
 
+// globalArgLines applies the global argument lines in the body of the
+// reference document up to the next other line.
+func (rr *RefReader) globalArgLines() error {
+	for rr.ll[0] == TagGlobalArg {
+		_, c1, line, err := rr.tokenize()
+		if err != nil {
+			return lineError(rr, err)
+		}
+		if err = rr.globalArg(c1, line); err != nil {
+			return fmt.Errorf("global arg line: %w", err)
+		}
+		if err = rr.scan(); err != nil {
+			return lineError(rr, err)
+		}
+	}
+	return nil
+}
+
+// globalArg applies a global argument line of type c1 to the global mask
+// template or to a named mask template. The argument type ArgTemplate
+// replaces the global template with a named template or removes it with
+// NoTemplate.
+func (rr *RefReader) globalArg(c1 rune, line []byte) error {
+	switch {
+	case unicode.IsLetter(c1):
+		return rr.namedTemplate(c1, line)
+	case c1 == ArgTemplate:
+		name := strings.TrimSpace(string(line))
+		if name == NoTemplate {
+			rr.globLT = nil
+			return nil
+		}
+		lt := rr.tmpls[name]
+		if lt == nil {
+			return lineErrorf(rr, "no mask template '%s'", name)
+		}
+		rr.globLT = &lineTemplate{
+			srcName: rr.Name(),
+			srcLine: rr.Line(),
+			masks:   cloneMasks(lt.masks),
+		}
+		return nil
+	}
+	if rr.globLT == nil {
+		rr.globLT = &lineTemplate{srcName: rr.Name(), srcLine: rr.Line()}
+	}
+	return rr.maskArg(rr.globLT, c1, line)
+}
+
+func (rr *RefReader) namedTemplate(c1 rune, line []byte) error {
+	name, typ, line, err := templateName(c1, line)
+	if err != nil {
+		return err
+	}
+	lt := rr.tmpls[name]
+	if lt == nil {
+		lt = &lineTemplate{srcName: rr.Name(), srcLine: rr.Line()}
+		if rr.tmpls == nil {
+			rr.tmpls = make(map[string]*lineTemplate)
+		}
+		rr.tmpls[name] = lt
+	}
+	return rr.maskArg(lt, typ, line)
+}
+
 var notIGroup = string([]byte{TagComment, TagIGroup, TagGlobalArg, TagRefLine})
 
 func (rr *RefReader) preamble() error {
 	for {
-		if err := rr.scan(); err != nil {
-			return err
+		if rr.ll == nil {
+			if err := rr.scan(); err != nil {
+				return err
+			}
+		}
+		if rr.bodyLine() {
+			return nil
 		}
 		c0, c1, line, err := rr.tokenize()
 		if err != nil {
 			return err
 		}
-		if c0 == TagRefLine {
-			return nil
-		}
 		switch c0 {
 		case TagGlobalArg:
-			segType, err := parseMaskType(c1)
-			if err != nil {
+			if err = rr.globalArg(c1, line); err != nil {
 				return err
 			}
-			if rr.globLT == nil {
-				rr.globLT = &lineTemplate{srcName: rr.Name(), srcLine: rr.Line()}
-			}
-			switch segType {
-			case maskMatch:
-				if err := rr.match(rr.globLT, line); err != nil {
-					return err
-				}
-			case maskClass:
-				if err = rr.class(rr.globLT, line); err != nil {
-					return err
-				}
-			default:
-				if err = rr.masks(rr.globLT, segType, line); err != nil {
-					return err
-				}
+		case TagForbidden:
+			fl, err := rr.textLine(c0, c1, line)
+			if err != nil {
+				return err
 			}
+			rr.pre.Forbidden = append(rr.pre.Forbidden, fl)
+			continue // textLine already read the next line
 		case TagIGroup:
 			switch c1 {
 			case TagIGroup:
 				if rr.ilgs != nil {
 					return lineErrorf(rr, "redefining interleafing groups")
 				}
-				if i := bytes.IndexAny(line, notIGroup); i >= 0 {
-					nig, _ := utf8.DecodeRune(line[i:])
-					return lineErrorf(rr,
-						"illegal interleaving group name '%c' (not allowed: %s)",
-						nig,
-						notIGroup,
-					)
+				if err = rr.declareIGroups(line); err != nil {
+					return lineError(rr, err)
 				}
-				rr.ilgs = []rune(string(line))
 			default:
 				return lineErrorf(rr, "invalid preamble line %c%c…", c0, c1)
 			}
@@ -314,18 +1201,225 @@ func (rr *RefReader) preamble() error {
 	}
 }
 
+// igNameBase is the first rune of the runes that represent named
+// interleaving groups. It is in the Supplementary Private Use Area-A.
+const igNameBase = 0xF0000
+
+// declareIGroups declares the interleaving groups of the preamble line
+// starting with "%%". Each rune is a group except a list of group names
+// in braces, e.g. "a{db,http}".
+func (rr *RefReader) declareIGroups(line []byte) error {
+	rr.ilgs = []rune{}
+	for len(line) > 0 {
+		ig, sz := utf8.DecodeRune(line)
+		if ig != '{' {
+			if ig == utf8.RuneError || strings.ContainsRune(notIGroup, ig) {
+				return fmt.Errorf("illegal interleaving group name '%c' (not allowed: %s)",
+					ig,
+					notIGroup,
+				)
+			}
+			if slices.Contains(rr.ilgs, ig) {
+				return fmt.Errorf("redefining interleaving group '%c'", ig)
+			}
+			rr.ilgs = append(rr.ilgs, ig)
+			line = line[sz:]
+			continue
+		}
+		end := bytes.IndexByte(line, '}')
+		if end < 0 {
+			return errors.New("unterminated interleaving group names")
+		}
+		for _, name := range strings.Split(string(line[1:end]), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				return errors.New("empty interleaving group name")
+			}
+			if _, ok := rr.igNames[name]; ok {
+				return fmt.Errorf("redefining interleaving group '%s'", name)
+			}
+			if utf8.RuneCountInString(name) == 1 {
+				ig, _ = utf8.DecodeRuneInString(name)
+				if slices.Contains(rr.ilgs, ig) {
+					return fmt.Errorf("redefining interleaving group '%s'", name)
+				}
+			} else {
+				ig = igNameBase + rune(len(rr.igNames))
+			}
+			if rr.igNames == nil {
+				rr.igNames = make(map[string]rune)
+			}
+			rr.igNames[name] = ig
+			rr.ilgs = append(rr.ilgs, ig)
+		}
+		line = line[end+1:]
+	}
+	return nil
+}
+
+// namedIGroup returns the interleaving group of a reference line where ig is
+// the rune in the group column. If ig is '{', the group name up to '}' is
+// taken from the start of rest. It returns the text after the group.
+func (rr *RefReader) namedIGroup(ig rune, rest []byte) (rune, []byte, error) {
+	if ig != '{' {
+		return ig, rest, nil
+	}
+	end := bytes.IndexByte(rest, '}')
+	if end < 0 {
+		return 0, rest, errors.New("unterminated interleaving group name")
+	}
+	name := string(rest[:end])
+	nig, ok := rr.igNames[name]
+	if !ok {
+		return 0, rest, fmt.Errorf("undeclared interleaving group '%s'", name)
+	}
+	return nig, rest[end+1:], nil
+}
+
+// igLabel returns the name of the interleaving group ig.
+func (rr *RefReader) igLabel(ig rune) string {
+	for name, nig := range rr.igNames {
+		if nig == ig {
+			return name
+		}
+	}
+	return string(ig)
+}
+
+// bodyLine reports if the current line is a line of the reference document's
+// body, i.e. it ends the preamble.
+func (rr *RefReader) bodyLine() bool {
+	if bytes.HasPrefix(rr.ll, []byte(SkipLine)) {
+		return true
+	}
+	switch rr.ll[0] {
+	case TagRefLine, TagOptRefLine, TagBlockStart, TagSetStart, TagBarrier:
+		return true
+	}
+	return false
+}
+
 func (rr *RefReader) scan() error {
 	for {
 		if !rr.scn.Scan() {
 			rr.ll = nil
-			return io.EOF
+			if err := rr.scn.Err(); err != nil {
+				return err
+			}
+			if len(rr.incl) == 0 {
+				return io.EOF
+			}
+			if err := rr.endInclude(); err != nil {
+				return err
+			}
+			continue
 		}
 		l := rr.scn.Bytes()
 		rr.lno++
+		if rr.scn.Long() {
+			rr.ll = nil
+			return fmt.Errorf("line exceeds maximum length of %d bytes", rr.maxLen)
+		}
 		if trimmed := bytes.TrimSpace(l); len(trimmed) == 0 {
 			rr.ll = nil
 			return errors.New("empty reference line")
 		}
+		if key, arg, ok := directive(l); ok {
+			switch key {
+			case DirInclude:
+				if err := rr.include(arg); err != nil {
+					return err
+				}
+				continue
+			case DirCase:
+				switch arg {
+				case "fold":
+					rr.fold = true
+				case "exact":
+					rr.fold = false
+				default:
+					return fmt.Errorf("illegal case mode '%s'", arg)
+				}
+				continue
+			case DirReplace, DirPaths, DirEnv:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				if err := rr.rewriteDirective(key, arg); err != nil {
+					return err
+				}
+				continue
+			case DirContinue:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				var err error
+				if rr.pre.Continuation, err = regexp.Compile(arg); err != nil {
+					return fmt.Errorf("continue: %w", err)
+				}
+				continue
+			case DirEncoding:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				var err error
+				if rr.pre.Encoding, err = ParseEncoding(arg); err != nil {
+					return err
+				}
+				continue
+			case DirMasks:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				if err := rr.masksDirective(arg); err != nil {
+					return err
+				}
+				continue
+			case DirGroup:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				if err := rr.groupDirective(arg); err != nil {
+					return err
+				}
+				continue
+			case DirBarrier:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				if err := rr.barrierDirective(arg); err != nil {
+					return err
+				}
+				continue
+			case DirInstances:
+				if rr.body {
+					return fmt.Errorf("%s directive after preamble", key)
+				}
+				if err := rr.instancesDirective(arg); err != nil {
+					return err
+				}
+				continue
+			case DirFilter:
+				if rr.body {
+					return errors.New("filter directive after preamble")
+				}
+				rgx, err := regexp.Compile(arg)
+				if err != nil {
+					return fmt.Errorf("filter: %w", err)
+				}
+				rr.pre.Filters = append(rr.pre.Filters, &Filter{
+					srcName: rr.Name(),
+					srcLine: rr.Line(),
+					rgx:     rgx,
+				})
+				continue
+			case DirSpace:
+				var err error
+				if rr.space, err = ParseSpaceMode(arg); err != nil {
+					return err
+				}
+				continue
+			}
+		}
 		if l[0] != '#' {
 			rr.ll = l
 			break
@@ -334,6 +1428,201 @@ func (rr *RefReader) scan() error {
 	return nil
 }
 
+// instancesDirective parses the argument "<group> <key> [<count>]" of a
+// DirInstances directive.
+func (rr *RefReader) instancesDirective(arg string) error {
+	fs := strings.Fields(arg)
+	if len(fs) < 2 || len(fs) > 3 {
+		return fmt.Errorf("instances: expect group, key mask and count, have '%s'", arg)
+	}
+	ig, sz := utf8.DecodeRuneInString(fs[0])
+	ig, rest, err := rr.namedIGroup(ig, []byte(fs[0][sz:]))
+	if err != nil {
+		return fmt.Errorf("instances: %w", err)
+	}
+	key := []rune(fs[1])
+	if len(rest) > 0 || len(key) != 1 {
+		return fmt.Errorf("instances: group and key mask must be single runes, have '%s'", arg)
+	}
+	if rr.groupTemplate(ig) != nil {
+		return fmt.Errorf("instances: redefining group template '%s'", rr.igLabel(ig))
+	}
+	count := "*"
+	if len(fs) == 3 {
+		count = fs[2]
+	}
+	min, max, err := parseSkip(count)
+	if err != nil {
+		return fmt.Errorf("instances: %w", err)
+	}
+	rr.pre.GroupTemplates = append(rr.pre.GroupTemplates, &GroupTemplate{
+		srcName: rr.Name(),
+		srcLine: rr.Line(),
+		igName:  ig,
+		igLabel: rr.igLabel(ig),
+		key:     key[0],
+		min:     min,
+		max:     max,
+	})
+	return nil
+}
+
+// groupDirective parses the argument "<group> <policy>" of a DirGroup
+// directive.
+func (rr *RefReader) groupDirective(arg string) error {
+	name, policy, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	if name == "" || strings.TrimSpace(policy) == "" {
+		return fmt.Errorf("group: expect group and policy, have '%s'", arg)
+	}
+	ig, sz := utf8.DecodeRuneInString(name)
+	ig, rest, err := rr.namedIGroup(ig, []byte(name[sz:]))
+	if err != nil {
+		return fmt.Errorf("group: %w", err)
+	}
+	if len(rest) > 0 || !slices.Contains(rr.ilgs, ig) {
+		return fmt.Errorf("group: undeclared interleaving group '%s'", name)
+	}
+	if _, ok := rr.pre.Policies[ig]; ok {
+		return fmt.Errorf("group: redefining policy of '%s'", name)
+	}
+	p, err := ParseGroupPolicy(policy)
+	if err != nil {
+		return fmt.Errorf("group: %w", err)
+	}
+	if rr.pre.Policies == nil {
+		rr.pre.Policies = make(map[rune]GroupPolicy)
+	}
+	rr.pre.Policies[ig] = p
+	return nil
+}
+
+// barrierDirective parses the argument "<name> <groups>" of a DirBarrier
+// directive. The groups are written like in the declaration of interleaving
+// groups, e.g. "12{db}".
+func (rr *RefReader) barrierDirective(arg string) error {
+	fs := strings.Fields(arg)
+	if len(fs) != 2 {
+		return fmt.Errorf("barrier: expect name and groups, have '%s'", arg)
+	}
+	if slices.ContainsFunc(rr.pre.Barriers, func(b *Barrier) bool { return b.name == fs[0] }) {
+		return fmt.Errorf("barrier: redefining barrier '%s'", fs[0])
+	}
+	b := &Barrier{
+		srcName: rr.Name(),
+		srcLine: rr.Line(),
+		name:    fs[0],
+	}
+	for line := []byte(fs[1]); len(line) > 0; {
+		ig, sz := utf8.DecodeRune(line)
+		if ig == utf8.RuneError {
+			return errors.New("barrier: invalid UTF-8 encoding")
+		}
+		ig, rest, err := rr.namedIGroup(ig, line[sz:])
+		if err != nil {
+			return fmt.Errorf("barrier: %w", err)
+		}
+		if slices.Contains(b.groups, ig) {
+			return fmt.Errorf("barrier: duplicate interleaving group '%s'", rr.igLabel(ig))
+		}
+		b.groups = append(b.groups, ig)
+		b.labels = append(b.labels, rr.igLabel(ig))
+		line = rest
+	}
+	if len(b.groups) < 2 {
+		return fmt.Errorf("barrier: '%s' needs at least two interleaving groups", b.name)
+	}
+	rr.pre.Barriers = append(rr.pre.Barriers, b)
+	return nil
+}
+
+// groupTemplate returns the group template of the interleaving group ig or
+// nil.
+func (rr *RefReader) groupTemplate(ig rune) *GroupTemplate {
+	for _, gt := range rr.pre.GroupTemplates {
+		if gt.igName == ig {
+			return gt
+		}
+	}
+	return nil
+}
+
+func (rr *RefReader) rewriteDirective(key, arg string) error {
+	var rws []*Rewrite
+	switch key {
+	case DirReplace:
+		rgx, repl, err := parseReplace(arg)
+		if err != nil {
+			return err
+		}
+		rws = []*Rewrite{{rgx: rgx, repl: []byte(repl)}}
+	case DirPaths:
+		if arg != "" {
+			return fmt.Errorf("unexpected argument of %s directive", key)
+		}
+		rws = []*Rewrite{{
+			rgx:     regexp.MustCompile(`\\`),
+			repl:    []byte("/"),
+			literal: true,
+		}}
+	case DirEnv:
+		names := strings.Fields(arg)
+		if len(names) == 0 {
+			return fmt.Errorf("missing variable names of %s directive", key)
+		}
+		rws = envRewrites(names)
+	}
+	for _, rw := range rws {
+		rw.srcName, rw.srcLine = rr.Name(), rr.Line()
+	}
+	rr.pre.Rewrites = append(rr.pre.Rewrites, rws...)
+	return nil
+}
+
+// directive splits a directive line into its keyword and its argument.
+func directive(line []byte) (key, arg string, ok bool) {
+	if len(line) == 0 || line[0] != TagDirective {
+		return "", "", false
+	}
+	key, arg, _ = strings.Cut(string(line[1:]), " ")
+	return key, strings.TrimSpace(arg), true
+}
+
+func (rr *RefReader) include(file string) error {
+	if file == "" {
+		return errors.New("missing file to include")
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(rr.src), file)
+	}
+	file = filepath.Clean(file)
+	isFile := func(s refSource) bool { return filepath.Clean(s.src) == file }
+	if isFile(rr.refSource) || slices.ContainsFunc(rr.incl, isFile) {
+		return fmt.Errorf("include cycle with %s", file)
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	rr.incl = append(rr.incl, rr.refSource)
+	rr.refSource = refSource{
+		src: file,
+		rd:  r,
+		scn: newLineScanner(r, rr.maxLen),
+	}
+	return nil
+}
+
+func (rr *RefReader) endInclude() error {
+	var err error
+	if c, ok := rr.rd.(io.Closer); ok {
+		err = c.Close()
+	}
+	last := len(rr.incl) - 1
+	rr.refSource = rr.incl[last]
+	rr.incl = rr.incl[:last]
+	return err
+}
+
 func (rr *RefReader) tokenize() (c0, c1 rune, rest []byte, err error) {
 	line := rr.ll
 	c0, csz := utf8.DecodeRune(line)
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	"git.fractalqb.de/fractalqb/testerr"
@@ -23,7 +26,7 @@ func ExampleRefReader() {
 		fmt.Println(err)
 		return
 	}
-	fmt.Println(rl.regexp())
+	fmt.Println(rl.regexp(nil))
 	fmt.Println(ref.NextLine())
 	// Output:
 	// ^foo (.{3}) baz$
@@ -44,3 +47,214 @@ func TestRefReader_ILGs(t *testing.T) {
 		t.Fatal("missing match")
 	}
 }
+
+func Test_parseSkip(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		min, max int
+	}{
+		{"", 1, 1},
+		{"3", 3, 3},
+		{"2..5", 2, 5},
+		{"2..", 2, -1},
+		{"*", 0, -1},
+	} {
+		min, max, err := parseSkip(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("skip '%s': %d..%d, want %d..%d", test.s, min, max, test.min, test.max)
+		}
+	}
+	for _, s := range []string{"x", "5..2", "-1", "1..x"} {
+		if _, _, err := parseSkip(s); err == nil {
+			t.Errorf("no error for skip '%s'", s)
+		}
+	}
+}
+
+func TestRefReader_include(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		name = filepath.Join(dir, name)
+		testerr.Shall(os.MkdirAll(filepath.Dir(name), 0777)).BeNil(t)
+		testerr.Shall(os.WriteFile(name, []byte(content), 0666)).BeNil(t)
+		return name
+	}
+	banner := write("common/banner.texst", "> banner 1\n> banner 2\n")
+	main := write("main.texst", "> start\n@include common/banner.texst\n> end\n")
+	t.Run("splice", func(t *testing.T) {
+		ref := testerr.Shall1(OpenRefFile(main)).BeNil(t)
+		defer ref.Close()
+		var lines []string
+		for {
+			rl, err := ref.NextLine()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("%s:%d:%s",
+				filepath.Base(rl.SourceName()),
+				rl.SourceLine(),
+				rl.Text(),
+			))
+		}
+		if !slices.Equal(lines, []string{
+			"main.texst:1:start",
+			"banner.texst:1:banner 1",
+			"banner.texst:2:banner 2",
+			"main.texst:3:end",
+		}) {
+			t.Error("wrong lines", lines)
+		}
+	})
+	t.Run("cycle", func(t *testing.T) {
+		write("common/banner.texst", "> banner\n@include ../main.texst\n")
+		defer write("common/banner.texst", "> banner 1\n> banner 2\n")
+		ref := testerr.Shall1(OpenRefFile(main)).BeNil(t)
+		defer ref.Close()
+		testerr.Shall1(ref.NextLine()).BeNil(t)
+		_, err := ref.NextLine()
+		if err == nil || !strings.Contains(err.Error(), "include cycle") {
+			t.Error("expected include cycle, got", err)
+		}
+		if ref.Name() != banner {
+			t.Errorf("error in '%s', expected '%s'", ref.Name(), banner)
+		}
+	})
+	t.Run("absolute cycle", func(t *testing.T) {
+		abs := filepath.Join(dir, "common") + string(filepath.Separator) + ".." +
+			string(filepath.Separator) + "main.texst"
+		write("common/banner.texst", "> banner\n@include "+abs+"\n")
+		defer write("common/banner.texst", "> banner 1\n> banner 2\n")
+		ref := testerr.Shall1(OpenRefFile(main)).BeNil(t)
+		defer ref.Close()
+		testerr.Shall1(ref.NextLine()).BeNil(t)
+		_, err := ref.NextLine()
+		if err == nil || !strings.Contains(err.Error(), "include cycle") {
+			t.Error("expected include cycle, got", err)
+		}
+	})
+}
+
+func TestRefReader_templates(t *testing.T) {
+	const ref = `*.ttt
+*hd.h
+*hd~h [0-9a-f]+
+*tbl-     cccc
+> 123 default
+> abc header
+ @-
+ @hd
+> a     table
+ @tbl
+> 123 x y
+ @-
+ .    x
+> 123 z
+ @nope`
+	masks := func(rl *RefLine) (ms []string) {
+		for _, m := range rl.Masks() {
+			ms = append(ms, m.String())
+		}
+		return ms
+	}
+	rr := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	for _, want := range [][]string{
+		{"[t:0+3]"},
+		{"[h:0+1:[0-9a-f]+]"},
+		{"[t:0+3]", "[c:5+4]"},
+		{"[x:4+1]"},
+	} {
+		rl := testerr.Shall1(rr.NextLine()).BeNil(t)
+		if ms := masks(rl); !slices.Equal(ms, want) {
+			t.Errorf("line %d: masks %s, want %s", rl.SourceLine(), ms, want)
+		}
+	}
+	_, err := rr.NextLine()
+	if err == nil || !strings.Contains(err.Error(), "no mask template 'nope'") {
+		t.Error("expected unknown template, got", err)
+	}
+}
+
+func TestRefReader_globalArgs(t *testing.T) {
+	const ref = `*tbl-    nn
+> banner
+*.ttt
+> 123 log
+*.      ll
+> 123 a log
+*@tbl
+> x   42
+*@-
+> summary
+(
+*.x
+> a
+)`
+	rr := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	for _, want := range [][]string{
+		nil,
+		{"[t:0+3]"},
+		{"[t:0+3]", "[l:6+2]"},
+		{"[n:4+2]"},
+		nil,
+	} {
+		rl := testerr.Shall1(rr.NextLine()).BeNil(t)
+		var ms []string
+		for _, m := range rl.Masks() {
+			ms = append(ms, m.String())
+		}
+		if !slices.Equal(ms, want) {
+			t.Errorf("line %d: masks %s, want %s", rl.SourceLine(), ms, want)
+		}
+	}
+	blk := testerr.Shall1(rr.NextLine()).BeNil(t)
+	if sub := blk.Block(); len(sub) != 1 || len(sub[0].Masks()) != 1 {
+		t.Error("global masks in block", sub)
+	}
+}
+
+func TestRefReader_groupMasks(t *testing.T) {
+	const ref = `%%12{db}
+*id.    nn
+*.ttt
+@masks 2 id
+@masks {db} id only
+@masks 1 id
+@masks 1 -
+>1123 a
+>2123 42
+>{db}x   42`
+	rr := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	for _, want := range [][]string{
+		{"[t:0+3]"},
+		{"[t:0+3]", "[n:4+2]"},
+		{"[n:4+2]"},
+	} {
+		rl := testerr.Shall1(rr.NextLine()).BeNil(t)
+		var ms []string
+		for _, m := range rl.Masks() {
+			ms = append(ms, m.String())
+		}
+		if !slices.Equal(ms, want) {
+			t.Errorf("line %d: masks %s, want %s", rl.SourceLine(), ms, want)
+		}
+	}
+	for _, ref := range []string{
+		"%%1\n@masks 1 nope\n>1x",
+		"%%1\n*id.  nn\n@masks q id\n>1x",
+		"*id.  nn\n@masks 1 id\n%%1\n>1x",
+		"%%1\n*id.  nn\n>1x\n@masks 1 id\n>1y",
+	} {
+		refRd, err := NewRefString(t.Name(), ref)
+		for err == nil {
+			_, err = refRd.NextLine()
+		}
+		if errors.Is(err, io.EOF) {
+			t.Errorf("no error for reference %q", ref)
+		}
+	}
+}
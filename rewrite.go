@@ -0,0 +1,83 @@
+package texst
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// RewriteFunc is called for each subject line that was changed by the subject
+// rewrites before it is reported as match or mismatch.
+type RewriteFunc func(testedNo int, original, rewritten []byte)
+
+// A Rewrite changes subject lines before they are compared to reference
+// lines. Rewrites are declared in the preamble with the directives
+// DirReplace, DirPaths and DirEnv.
+type Rewrite struct {
+	srcName string
+	srcLine int
+	rgx     *regexp.Regexp
+	repl    []byte
+	literal bool // Do not expand $ in repl
+}
+
+func (r *Rewrite) SourceName() string { return r.srcName }
+func (r *Rewrite) SourceLine() int    { return r.srcLine }
+
+func (r *Rewrite) String() string {
+	return fmt.Sprintf("%s -> %s", r.rgx, r.repl)
+}
+
+func (r *Rewrite) apply(line []byte) []byte {
+	if !r.rgx.Match(line) {
+		return line
+	}
+	if r.literal {
+		return r.rgx.ReplaceAllLiteral(line, r.repl)
+	}
+	return r.rgx.ReplaceAll(line, r.repl)
+}
+
+// parseReplace parses the argument of a replace directive "/regexp/repl/"
+// where the first rune is used as delimiter. The replacement can refer to
+// submatches with $1 or ${name}.
+func parseReplace(arg string) (rgx *regexp.Regexp, repl string, err error) {
+	delim, sz := utf8.DecodeRuneInString(arg)
+	if delim == utf8.RuneError {
+		return nil, "", fmt.Errorf("illegal replace '%s'", arg)
+	}
+	parts := strings.Split(arg[sz:], string(delim))
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, "", fmt.Errorf("illegal replace '%s', expect %[2]cregexp%[2]crepl%[2]c", arg, delim)
+	}
+	if rgx, err = regexp.Compile(parts[0]); err != nil {
+		return nil, "", err
+	}
+	return rgx, parts[1], nil
+}
+
+// envRewrites returns the rewrites that replace the values of the
+// environment variables names with the placeholders $NAME. Unset or empty
+// variables are ignored. Longer values are replaced first, e.g. TMPDIR in
+// HOME before HOME.
+func envRewrites(names []string) (rws []*Rewrite) {
+	names = slices.Clone(names)
+	slices.SortStableFunc(names, func(m, n string) int {
+		return len(os.Getenv(n)) - len(os.Getenv(m))
+	})
+	for _, name := range names {
+		val := os.Getenv(name)
+		if val == "" {
+			continue
+		}
+		rws = append(rws, &Rewrite{
+			rgx:     regexp.MustCompile(regexp.QuoteMeta(val)),
+			repl:    []byte("$" + name),
+			literal: true,
+		})
+	}
+	return rws
+}
@@ -0,0 +1,238 @@
+package texst
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// AmbiguousError explains a mismatch where a subject line matches reference
+// lines of several interleaving groups and the search for an assignment of
+// the subject lines to interleaving groups exceeded its budget, see
+// Texst.SearchBudget.
+type AmbiguousError struct {
+	Refs   []*RefLine // The matching reference lines
+	Budget int
+}
+
+func (e *AmbiguousError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("ambiguous reference: line matches")
+	for i, rl := range e.Refs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, " %s:%d", rl.SourceName(), rl.SourceLine())
+	}
+	fmt.Fprintf(&sb, ", no assignment found within %d backtracks", e.Budget)
+	return sb.String()
+}
+
+// choice assigns a subject record to an interleaving group. Records that are
+// not matched, e.g. filtered records, have the group -1.
+type choice struct {
+	ig   int
+	skip bool // Matched by a skip line
+}
+
+// alternative is a possible match of a subject record.
+type alternative struct {
+	choice
+	next  cursor
+	ref   *RefLine
+	match []int
+}
+
+// searchState is the matching state of all interleaving groups.
+type searchState struct {
+	pos     []cursor
+	started []bool
+	igs     []rune
+	policy  []GroupPolicy
+	caps    captures
+	clock   clocks
+	labels  labels
+	sync    *syncState
+}
+
+func (s *searchState) clone() searchState {
+	return searchState{
+		pos:     slices.Clone(s.pos),
+		started: slices.Clone(s.started),
+		igs:     s.igs,
+		policy:  s.policy,
+		caps:    maps.Clone(s.caps),
+		clock: clocks{
+			last:  maps.Clone(s.clock.last),
+			marks: maps.Clone(s.clock.marks),
+		},
+		labels: maps.Clone(s.labels),
+		sync:   s.sync.clone(),
+	}
+}
+
+// newSearchState returns the state of the interleaving groups igbl with the
+// bindings of mc. The state shares the bindings with mc.
+func newSearchState(igbl []igState, mc *matchCtx) searchState {
+	st := searchState{
+		pos:     make([]cursor, len(igbl)),
+		started: make([]bool, len(igbl)),
+		igs:     make([]rune, len(igbl)),
+		policy:  make([]GroupPolicy, len(igbl)),
+		caps:    mc.caps,
+		clock:   mc.clock,
+		labels:  mc.labels,
+		sync:    mc.sync,
+	}
+	for i := range igbl {
+		st.pos[i] = igbl[i].cursor()
+		st.started[i] = igbl[i].started
+		st.igs[i] = igbl[i].name
+		st.policy[i] = igbl[i].policy
+	}
+	return st
+}
+
+// alternatives returns the matches of line with the lines in question of all
+// interleaving groups. Like step, skip lines only take the subject line if
+// no reference line matches.
+func (s *searchState) alternatives(line []byte) (alts []alternative) {
+	var (
+		cs     []cursor
+		absent []rune
+	)
+	for i, c := range s.pos {
+		if s.policy[i].absent(s.started[i]) {
+			absent = append(absent, s.igs[i])
+		} else {
+			cs = append(cs, c)
+		}
+	}
+	s.sync.update(cs, absent)
+	for i, c := range s.pos {
+		s.pos[i] = s.sync.release(c, s.policy[i].absent(s.started[i]))
+	}
+	mc := matchCtx{line: line, caps: s.caps, clock: s.clock, labels: s.labels, sync: s.sync}
+	for _, mc.skip = range []bool{false, true} {
+		for i, c := range s.pos {
+			if next, rl, match := c.step(&mc); rl != nil {
+				alts = append(alts, alternative{
+					choice: choice{ig: i, skip: mc.skip},
+					next:   next,
+					ref:    rl,
+					match:  match,
+				})
+			}
+		}
+		if len(alts) > 0 {
+			break
+		}
+	}
+	return alts
+}
+
+func (s *searchState) apply(alt *alternative, rec *subjectRecord) {
+	s.sync.pass(s.pos[alt.ig], alt.next)
+	s.pos[alt.ig] = alt.next
+	if alt.ref.kind != skipLine {
+		s.started[alt.ig] = true
+	}
+	s.caps.bind(alt.ref, rec.lno, rec.line, alt.match)
+	s.clock.bind(alt.ref, rec.lno, rec.line, alt.match)
+	s.labels.bind(alt.ref, rec.lno)
+}
+
+func (s *searchState) final() bool {
+	for i, c := range s.pos {
+		if !s.policy[i].final(c, s.started[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchFrame is a subject record with alternatives that were not tried yet.
+type searchFrame struct {
+	rec   int
+	state searchState // The state before rec
+	alts  []alternative
+}
+
+// search looks for an assignment of the subject records to interleaving
+// groups such that all records match and all reference lines are complete.
+// The records are rec and the records ahead of it in sr. The search is a
+// depth-first search that tries the alternatives in the order of the
+// interleaving groups. It gives up when the backtracks exceed budget and
+// subtracts the backtracks from budget otherwise. The result plan
+// has the choices for rec and the records ahead of it. If there is no such
+// assignment, plan has the choices for the longest prefix of the records
+// that match. It is nil if the search exceeded the budget.
+func search(
+	sr *subjectReader,
+	rec subjectRecord,
+	igbl []igState,
+	mc *matchCtx,
+	budget *int,
+) (plan []choice, exceeded bool) {
+	record := func(i int) (subjectRecord, bool) {
+		if i == 0 {
+			return rec, true
+		}
+		return sr.peek(i - 1)
+	}
+	st := newSearchState(igbl, mc)
+	st = st.clone()
+	var (
+		stack []searchFrame
+		best  []choice // Longest plan of a dead end
+	)
+	for i := 0; ; {
+		r, ok := record(i)
+		if !ok && st.final() {
+			return plan, false
+		}
+		if ok && (r.long || r.filter >= 0) {
+			plan = append(plan, choice{ig: -1})
+			i++
+			continue
+		}
+		var alts []alternative
+		if ok {
+			alts = st.alternatives(r.line)
+		}
+		if len(alts) == 0 {
+			if len(plan) > len(best) {
+				best = slices.Clone(plan)
+			}
+			// Backtrack to the last record with untried alternatives
+			if len(stack) == 0 {
+				return best, false
+			}
+			if *budget--; *budget < 0 {
+				*budget = 0
+				return nil, true
+			}
+			top := &stack[len(stack)-1]
+			i, alts = top.rec, top.alts
+			if len(alts) > 1 {
+				st = top.state.clone()
+				top.alts = alts[1:]
+			} else {
+				st = top.state
+				stack = stack[:len(stack)-1]
+			}
+			plan = plan[:i]
+			r, _ = record(i)
+		} else if len(alts) > 1 {
+			stack = append(stack, searchFrame{
+				rec:   i,
+				state: st.clone(),
+				alts:  alts[1:],
+			})
+		}
+		st.apply(&alts[0], &r)
+		plan = append(plan, alts[0].choice)
+		i++
+	}
+}
@@ -0,0 +1,224 @@
+package texst
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// lineScanner scans lines like bufio.Scanner with bufio.ScanLines but
+// without a limit for the line length if max <= 0. Lines that exceed max
+// bytes are truncated to max bytes and reported by Long.
+type lineScanner struct {
+	rd   *bufio.Reader
+	max  int
+	line []byte
+	long bool
+	err  error
+}
+
+func newLineScanner(r io.Reader, max int) *lineScanner {
+	return &lineScanner{rd: bufio.NewReader(r), max: max}
+}
+
+func (ls *lineScanner) Scan() bool {
+	if ls.err != nil {
+		return false
+	}
+	ls.line = ls.line[:0]
+	read := 0
+	for {
+		frag, err := ls.rd.ReadSlice('\n')
+		read += len(frag)
+		// Keep 2 bytes more than max for the line terminator
+		if ls.max <= 0 || len(ls.line) <= ls.max+2 {
+			ls.line = append(ls.line, frag...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			ls.err = err
+			if read == 0 || !errors.Is(err, io.EOF) {
+				return false
+			}
+		}
+		break
+	}
+	ls.line = bytes.TrimSuffix(ls.line, []byte{'\n'})
+	ls.line = bytes.TrimSuffix(ls.line, []byte{'\r'})
+	if ls.long = ls.max > 0 && len(ls.line) > ls.max; ls.long {
+		ls.line = ls.line[:ls.max]
+	}
+	return true
+}
+
+// Bytes returns the current line. It is valid until the next call of Scan.
+func (ls *lineScanner) Bytes() []byte { return ls.line }
+
+// Long reports if the current line was truncated because it exceeds the
+// maximum line length.
+func (ls *lineScanner) Long() bool { return ls.long }
+
+func (ls *lineScanner) Err() error {
+	if errors.Is(ls.err, io.EOF) {
+		return nil
+	}
+	return ls.err
+}
+
+// LineLengthError explains a mismatch of a subject line that exceeds the
+// maximum line length, see Texst.MaxLineLen.
+type LineLengthError struct {
+	Max int
+}
+
+func (e *LineLengthError) Error() string {
+	return fmt.Sprintf("line exceeds maximum length of %d bytes", e.Max)
+}
+
+// subjectScanner scans the records of a subject text. A record is a line
+// together with the following continuation lines that match cont. Without
+// cont each line is a record. Continuation lines are joined with '\n'.
+type subjectScanner struct {
+	scn     *lineScanner
+	cont    *regexp.Regexp
+	rec     []byte
+	next    []byte // Line read ahead if hasNext
+	hasNext bool
+	nextTL  bool // Line read ahead is too long
+	long    bool // Current record has a line that is too long
+	lno     int  // Line number of the first line of the current record
+	end     int  // Line number of the last line read
+}
+
+func newSubjectScanner(subject io.Reader, cont *regexp.Regexp, max int) *subjectScanner {
+	return &subjectScanner{
+		scn:  newLineScanner(subject, max),
+		cont: cont,
+	}
+}
+
+func (ss *subjectScanner) Scan() bool {
+	if ss.cont == nil {
+		if !ss.scn.Scan() {
+			return false
+		}
+		ss.end++
+		ss.lno = ss.end
+		ss.rec = ss.scn.Bytes()
+		ss.long = ss.scn.Long()
+		return true
+	}
+	if !ss.hasNext {
+		if !ss.scn.Scan() {
+			return false
+		}
+		ss.end++
+		ss.next = append(ss.next[:0], ss.scn.Bytes()...)
+		ss.nextTL = ss.scn.Long()
+	}
+	ss.rec = append(ss.rec[:0], ss.next...)
+	ss.long = ss.nextTL
+	ss.lno = ss.end
+	ss.hasNext = false
+	for ss.scn.Scan() {
+		ss.end++
+		line := ss.scn.Bytes()
+		if !ss.cont.Match(line) {
+			ss.next = append(ss.next[:0], line...)
+			ss.nextTL = ss.scn.Long()
+			ss.hasNext = true
+			return true
+		}
+		ss.rec = append(ss.rec, '\n')
+		ss.rec = append(ss.rec, line...)
+		ss.long = ss.long || ss.scn.Long()
+	}
+	return true
+}
+
+// Bytes returns the current record. It is valid until the next call of Scan.
+func (ss *subjectScanner) Bytes() []byte { return ss.rec }
+
+// Line returns the line number of the first line of the current record.
+func (ss *subjectScanner) Line() int { return ss.lno }
+
+// Long reports if a line of the current record exceeds the maximum line
+// length.
+func (ss *subjectScanner) Long() bool { return ss.long }
+
+func (ss *subjectScanner) Err() error { return ss.scn.Err() }
+
+// subjectRecord is a record of the subject text with the subject rewrites
+// applied.
+type subjectRecord struct {
+	lno    int
+	orig   []byte // The record before rewriting
+	line   []byte // The record after rewriting
+	long   bool   // A line of the record exceeds the maximum line length
+	filter int    // Index of the filter that drops the record, -1 if none
+}
+
+// subjectReader reads the records of a subject text and can look ahead of the
+// current record.
+type subjectReader struct {
+	scn      *subjectScanner
+	rewrites []*Rewrite
+	filters  []*Filter
+	ahead    []subjectRecord
+}
+
+// next returns the next record. Records that were not looked ahead are valid
+// until the next call of next or peek.
+func (sr *subjectReader) next() (rec subjectRecord, ok bool) {
+	if len(sr.ahead) > 0 {
+		rec = sr.ahead[0]
+		sr.ahead[0] = subjectRecord{}
+		sr.ahead = sr.ahead[1:]
+		return rec, true
+	}
+	return sr.read(false)
+}
+
+// peek returns the i-th record after the current record.
+func (sr *subjectReader) peek(i int) (subjectRecord, bool) {
+	for len(sr.ahead) <= i {
+		rec, ok := sr.read(true)
+		if !ok {
+			return rec, false
+		}
+		sr.ahead = append(sr.ahead, rec)
+	}
+	return sr.ahead[i], true
+}
+
+func (sr *subjectReader) read(keep bool) (rec subjectRecord, ok bool) {
+	if !sr.scn.Scan() {
+		return rec, false
+	}
+	rec.lno = sr.scn.Line()
+	rec.orig = sr.scn.Bytes()
+	if keep {
+		rec.orig = bytes.Clone(rec.orig)
+	}
+	rec.long = sr.scn.Long()
+	rec.line = rec.orig
+	rec.filter = -1
+	if rec.long {
+		return rec, true
+	}
+	for _, rw := range sr.rewrites {
+		rec.line = rw.apply(rec.line)
+	}
+	for i, f := range sr.filters {
+		if f.rgx.Match(rec.line) {
+			rec.filter = i
+			break
+		}
+	}
+	return rec, true
+}
@@ -0,0 +1,220 @@
+package texst
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// A Barrier synchronizes interleaving groups. Each participating group has a
+// barrier line with the name of the barrier. A group cannot match the lines
+// behind its barrier line until all participating groups have reached their
+// barrier line. Barriers are declared in the preamble with DirBarrier.
+type Barrier struct {
+	srcName string
+	srcLine int
+	name    string
+	groups  []rune
+	labels  []string
+}
+
+func (b *Barrier) SourceName() string { return b.srcName }
+func (b *Barrier) SourceLine() int    { return b.srcLine }
+func (b *Barrier) Name() string       { return b.name }
+
+// IGroups returns the participating interleaving groups.
+func (b *Barrier) IGroups() []rune { return b.groups }
+
+// BarrierError explains a mismatch of a subject line that matches a
+// reference line behind a barrier that some groups did not reach yet.
+type BarrierError struct {
+	Ref     *RefLine // The line behind the barrier
+	Barrier *Barrier
+	Waiting []string // Names of the groups that did not reach the barrier
+}
+
+func (e *BarrierError) Error() string {
+	return fmt.Sprintf("%s:%d: barrier '%s' waits for groups %s",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+		e.Barrier.Name(),
+		strings.Join(e.Waiting, ", "),
+	)
+}
+
+// OrderError explains a mismatch of a subject line that matches a reference
+// line that must happen after a labeled line that did not match yet.
+type OrderError struct {
+	Ref   *RefLine
+	Label string
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("%s:%d: must match after line labeled '%s'",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+		e.Label,
+	)
+}
+
+// labels are the subject line numbers of the first match of labeled
+// reference lines.
+type labels map[string]int
+
+// check returns an *OrderError if a label that rl must match after is not
+// bound yet.
+func (ls labels) check(rl *RefLine) error {
+	for _, l := range rl.after {
+		if _, ok := ls[l]; !ok {
+			return &OrderError{Ref: rl, Label: l}
+		}
+	}
+	return nil
+}
+
+func (ls labels) bind(rl *RefLine, lno int) {
+	if _, ok := ls[rl.label]; rl.label != "" && !ok {
+		ls[rl.label] = lno
+	}
+}
+
+// syncState tracks which groups reached their barrier lines.
+type syncState struct {
+	barriers map[string]*Barrier
+	reached  map[string]map[rune]bool // Groups that reached a barrier line
+	passed   map[string]bool          // Barriers a group went past
+	absent   map[rune]bool            // Optional groups that did not start
+}
+
+func newSyncState(bs []*Barrier) *syncState {
+	s := &syncState{
+		barriers: make(map[string]*Barrier),
+		reached:  make(map[string]map[rune]bool),
+		passed:   make(map[string]bool),
+		absent:   make(map[rune]bool),
+	}
+	for _, b := range bs {
+		s.barriers[b.name] = b
+	}
+	return s
+}
+
+func (s *syncState) clone() *syncState {
+	c := &syncState{
+		barriers: s.barriers,
+		reached:  make(map[string]map[rune]bool, len(s.reached)),
+		passed:   maps.Clone(s.passed),
+		absent:   maps.Clone(s.absent),
+	}
+	for n, r := range s.reached {
+		c.reached[n] = maps.Clone(r)
+	}
+	return c
+}
+
+// update records the barriers reached by the cursors cs and the groups that
+// are absent, see GroupOptional. Absent groups count as having reached all
+// barriers.
+func (s *syncState) update(cs []cursor, absent []rune) {
+	clear(s.absent)
+	for _, ig := range absent {
+		s.absent[ig] = true
+	}
+	for _, c := range cs {
+		b := c.barrier()
+		if b == nil {
+			continue
+		}
+		r := s.reached[b.text]
+		if r == nil {
+			r = make(map[rune]bool)
+			s.reached[b.text] = r
+		}
+		r[b.igName] = true
+	}
+}
+
+// released reports if all groups reached the barrier name. Without s all
+// barriers are released.
+func (s *syncState) released(name string) bool {
+	if s == nil {
+		return true
+	}
+	for _, ig := range s.barriers[name].groups {
+		if !s.reached[name][ig] && !s.absent[ig] {
+			return false
+		}
+	}
+	return true
+}
+
+// release returns the cursor at the barrier line that c reaches if the
+// barrier is released. Then the lines in front of the barrier line can no
+// longer match. When another group went past the next barrier of an absent
+// group, the group stays absent and release returns the cursor at the end
+// of the group. Otherwise release returns c.
+func (s *syncState) release(c cursor, absent bool) cursor {
+	if absent {
+		for rl := c.at; rl != nil; rl = rl.lsNext {
+			if rl.kind == barrierLine {
+				if s.passed[rl.text] {
+					return cursor{}
+				}
+				break
+			}
+		}
+		return c
+	}
+	if b := c.barrier(); b != nil && b != c.at && s.released(b.text) {
+		return cursor{at: b}
+	}
+	return c
+}
+
+// pass records that a group went past its barrier when it moved from c to
+// next.
+func (s *syncState) pass(c, next cursor) {
+	if b := c.barrier(); b != nil && next.barrier() != b {
+		s.passed[b.text] = true
+	}
+}
+
+// blocked returns a *BarrierError for the line rl behind the barrier name.
+func (s *syncState) blocked(rl *RefLine, name string) error {
+	b := s.barriers[name]
+	err := &BarrierError{Ref: rl, Barrier: b}
+	for i, ig := range b.groups {
+		if !s.reached[name][ig] && !s.absent[ig] {
+			err.Waiting = append(err.Waiting, b.labels[i])
+		}
+	}
+	return err
+}
+
+// barrier returns the barrier line that c reaches without matching more
+// subject lines or nil.
+func (c cursor) barrier() *RefLine {
+	for c.at != nil {
+		if c.at.kind == barrierLine {
+			return c.at
+		}
+		count := c.count
+		if c.in != nil {
+			if !c.in.final() {
+				return nil
+			}
+			count++
+		}
+		if c.set != nil {
+			if setMissing(c.at, c.set) != nil {
+				return nil
+			}
+			count++
+		}
+		if count < c.at.min && !c.at.emptyRep() {
+			return nil
+		}
+		c = cursor{at: c.at.lsNext}
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
 package texst
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
 	"slices"
 	"strings"
 )
@@ -23,11 +24,165 @@ const (
 	// Reference lines have the text that is compared to the subject text.
 	TagRefLine = '>'
 
+	// Optional reference lines are like reference lines but need not to match
+	// a subject line.
+	TagOptRefLine = '?'
+
+	// Starts a block of reference lines
+	TagBlockStart = '('
+
+	// Ends a block of reference lines, optionally followed by a repetition
+	// quantifier.
+	TagBlockEnd = ')'
+
+	// Starts an unordered block of reference lines
+	TagSetStart = '['
+
+	// Ends an unordered block of reference lines, optionally followed by a
+	// repetition quantifier.
+	TagSetEnd = ']'
+
+	// Continuation lines continue the text of the previous reference line
+	// with the next line of a subject record, see DirContinue.
+	TagContinue = '+'
+
+	// Forbidden lines have a text that must not match anywhere in any
+	// subject line. In the preamble they apply to the whole subject, in a
+	// block they apply while the block is matched.
+	TagForbidden = '!'
+
 	// Argument lines apply to the most recent '>' reference line up to the next
 	// non-argument line.
 	TagRefLineArg = ' '
+
+	// Barrier lines mark the position of an interleaving group at a barrier,
+	// e.g. "|1 done" for group '1' at the barrier "done", see DirBarrier.
+	TagBarrier = '|'
+
+	// Directive lines have a keyword that follows the tag and an optional
+	// argument separated by a space, e.g. "@include common.texst".
+	TagDirective = '@'
+)
+
+// Directive keywords
+const (
+	// Include the lines of the reference file given as argument.
+	DirInclude = "include"
+
+	// Subject lines that match the regular expression given as argument
+	// continue the record of the previous line, e.g. "@continue ^\s". Only
+	// allowed in the preamble.
+	DirContinue = "continue"
+
+	// Drop all subject lines that match the regular expression given as
+	// argument before matching. Only allowed in the preamble.
+	DirFilter = "filter"
+
+	// Replace all matches of a regular expression in subject lines before
+	// matching, e.g. "@replace /id=[0-9]+/id=N/". The first rune of the
+	// argument is the delimiter. Only allowed in the preamble.
+	DirReplace = "replace"
+
+	// Replace backslashes with slashes in subject lines before matching to
+	// normalize path separators. Only allowed in the preamble.
+	DirPaths = "paths"
+
+	// Replace the values of the environment variables given as argument with
+	// the placeholders $NAME in subject lines before matching, e.g.
+	// "@env HOME TMPDIR". Only allowed in the preamble.
+	DirEnv = "env"
+
+	// Set the space mode for all following reference lines, e.g.
+	// "@space collapse trailing", see ParseSpaceMode.
+	DirSpace = "space"
+
+	// Set case-insensitive matching for all following reference lines with
+	// the argument "fold" or reset it with "exact".
+	DirCase = "case"
+
+	// Set the masks of a named mask template as global masks of the
+	// reference lines of an interleaving group in addition to the global
+	// mask template, e.g. "@masks 1 json". With a third argument "only" the
+	// group's masks replace the global mask template. The template name
+	// NoTemplate removes the group's masks. Only allowed in the preamble
+	// after the declaration of the interleaving groups.
+	DirMasks = "masks"
+
+	// Make an interleaving group a template for group instances that are
+	// selected by the value of a key mask, e.g. "@instances w k 1..8" for
+	// group 'w' with key mask 'k' and 1 up to 8 instances. The number of
+	// instances is optional with the syntax of skip lines, see
+	// GroupTemplate. Only allowed in the preamble.
+	DirInstances = "instances"
+
+	// Set the encoding of the subject text, e.g. "@encoding latin1", see
+	// Encodings. Only allowed in the preamble.
+	DirEncoding = "encoding"
+
+	// Declare a barrier with its name and the participating interleaving
+	// groups, e.g. "@barrier done 12{db}", see Barrier. Only allowed in the
+	// preamble.
+	DirBarrier = "barrier"
+
+	// Set the policy of an interleaving group for the end of the subject,
+	// e.g. "@group w optional truncate", see ParseGroupPolicy. Only allowed
+	// in the preamble after the declaration of the interleaving groups.
+	DirGroup = "group"
+)
+
+// Argument line types that are not mask types
+const (
+	// Set the number of repetitions of a reference line, e.g. " {1,}".
+	ArgRepeat = '{'
+
+	// Make the named masks capturing masks, e.g. " =ab".
+	ArgCapture = '='
+
+	// Add a checker to a mask, e.g. " !m int 1..100" adds the checker "int"
+	// with the argument "1..100" to the mask m.
+	ArgCheck = '!'
+
+	// Declare a mask to be a timestamp with an optional order and the time
+	// layout, e.g. " ^t igroup StampMilli".
+	ArgTime = '^'
+
+	// Set a time mark to the timestamp of a mask, e.g. " &t start".
+	ArgTimeMark = '&'
+
+	// Bound the time gap from a time mark to the timestamp of a mask, e.g.
+	// " <t start 500ms".
+	ArgTimeGap = '<'
+
+	// Add the masks of a named mask template to a reference line, e.g.
+	// " @ts". The name NoTemplate removes the masks of the global mask
+	// template.
+	ArgTemplate = '@'
+
+	// Set the space mode of a reference line, e.g. " _collapse", see
+	// ParseSpaceMode.
+	ArgSpace = '_'
+
+	// Match the named masks case-insensitive, e.g. " %ab". Without mask names
+	// the whole reference line matches case-insensitive.
+	ArgFoldCase = '%'
+
+	// Label a reference line for happens-before constraints, e.g. " :ready".
+	ArgLabel = ':'
+
+	// Let a reference line only match after the lines with the given labels
+	// matched, e.g. " >ready".
+	ArgAfter = '>'
 )
 
+// NoTemplate is the template name of an argument line of type ArgTemplate that
+// removes the masks of the global mask template from a reference line.
+const NoTemplate = "-"
+
+// SkipLine is the keyword that starts a skip line. It is followed by the
+// interleaving group and the number of subject lines to skip, e.g. "skip 3",
+// "skip1 2..5" or "skip *".
+const SkipLine = "skip"
+
 type RefDoc interface {
 	Name() string
 	Line() int
@@ -36,6 +191,35 @@ type RefDoc interface {
 	FreeLine(*RefLine)
 }
 
+// PreambleDoc is implemented by reference documents that have a preamble.
+// The preamble of RefDoc implementations without this method is empty.
+type PreambleDoc interface {
+	Preamble() *Preamble
+}
+
+// Preamble holds the declarations from the preamble of a reference document
+// that apply to the whole subject.
+type Preamble struct {
+	Forbidden      []*RefLine     // Lines that must not match any subject line
+	Filters        []*Filter      // Subject filters
+	Rewrites       []*Rewrite     // Subject rewrites in the order of declaration
+	Continuation   *regexp.Regexp // Subject continuation lines or nil
+	Encoding       string         // Subject encoding, EncUTF8 if empty
+	GroupTemplates []*GroupTemplate
+	Barriers       []*Barrier
+	Policies       map[rune]GroupPolicy // Policies of interleaving groups
+}
+
+// preamble returns the preamble of ref, an empty one if ref has none.
+func preamble(ref RefDoc) *Preamble {
+	if pd, ok := ref.(PreambleDoc); ok {
+		if pre := pd.Preamble(); pre != nil {
+			return pre
+		}
+	}
+	return new(Preamble)
+}
+
 func lineError(ref RefDoc, err error) error {
 	return fmt.Errorf("%s:%d:%w", ref.Name(), ref.Line(), err)
 
@@ -48,13 +232,63 @@ func lineErrorf(ref RefDoc, form string, args ...any) error {
 	return errors.New(sb.String())
 }
 
+// MismatchFunc is called for each mismatch. The testedLine is the original
+// subject line, see Texst.OnRewrite for the rewritten line.
 type MismatchFunc func(testedNo int, testedLine []byte, ref []*RefLine)
-type MatchFunc func(testedNo int, testedLine []byte, ref *RefLine, match []int)
+
+// MatchFunc is called for each matching subject line. The testedLine is the
+// original subject line and rewritten is the line after rewriting that the
+// match indices refer to. Without rewrites, rewritten is testedLine.
+type MatchFunc func(testedNo int, testedLine, rewritten []byte, ref *RefLine, match []int)
+
+// ReasonFunc is called after a mismatch was reported for each reason that
+// explains the mismatch beyond the reference lines passed to the MismatchFunc.
+type ReasonFunc func(testedNo int, reason error)
+
+// ForbiddenFunc is called for each forbidden line that matches a subject line.
+// The testedLine is the original subject line.
+type ForbiddenFunc func(testedNo int, testedLine []byte, forbidden *RefLine)
+
+// FilterFunc is called after the check for each subject filter with the
+// number of subject lines the filter dropped.
+type FilterFunc func(filter *Filter, dropped int)
+
+// A Filter drops the subject lines that match its regular expression before
+// they are compared to reference lines.
+type Filter struct {
+	srcName string
+	srcLine int
+	rgx     *regexp.Regexp
+}
+
+func (f *Filter) SourceName() string { return f.srcName }
+func (f *Filter) SourceLine() int    { return f.srcLine }
+func (f *Filter) Regexp() string     { return f.rgx.String() }
 
 type Texst struct {
 	MismatchLimit int
 	OnMismatch    MismatchFunc
 	OnMatch       MatchFunc
+	OnReason      ReasonFunc
+	OnForbidden   ForbiddenFunc
+	OnFilter      FilterFunc
+	OnRewrite     RewriteFunc
+	// Encoding overrides the subject encoding of the reference document if
+	// not empty. The byte-exact mode EncBytes cannot be overridden because
+	// it changes the meaning of the reference text.
+	Encoding string
+	// MaxLineLen is the maximum length of subject lines in bytes. Longer
+	// lines are reported as mismatches with a *LineLengthError as reason.
+	// There is no limit if MaxLineLen <= 0.
+	MaxLineLen int
+	// SearchBudget enables the search for an assignment of subject lines to
+	// interleaving groups if > 0. When a subject line matches lines of
+	// several groups, the search looks ahead for the assignment that matches
+	// the longest prefix of the subject. After SearchBudget backtracks it
+	// gives up and reports the line as a mismatch with an *AmbiguousError.
+	// The search reads the subject and the reference into memory and does
+	// not apply to group templates.
+	SearchBudget int
 }
 
 func (txs *Texst) mismatch(lno int, line []byte, ref []*RefLine) {
@@ -63,126 +297,1051 @@ func (txs *Texst) mismatch(lno int, line []byte, ref []*RefLine) {
 	}
 }
 
-func (txs *Texst) match(lno int, line []byte, ref *RefLine, match []int) {
+func (txs *Texst) match(lno int, orig, line []byte, ref *RefLine, match []int) {
 	if txs.OnMatch != nil {
-		txs.OnMatch(lno, line, ref, match)
+		txs.OnMatch(lno, orig, line, ref, match)
+	}
+}
+
+func (txs *Texst) reason(lno int, reason error) {
+	if txs.OnReason != nil {
+		txs.OnReason(lno, reason)
+	}
+}
+
+func (txs *Texst) filtered(filters []*Filter, dropped []int) {
+	if txs.OnFilter == nil {
+		return
+	}
+	for i, f := range filters {
+		txs.OnFilter(f, dropped[i])
+	}
+}
+
+// forbidden reports the forbidden lines that match line, the rewritten
+// subject line orig. The forbidden lines of the reference document apply to
+// all lines, those of blocks only while a block is matched.
+func (txs *Texst) forbidden(lno int, orig, line []byte, ref RefDoc, igbl []igState) (violated bool) {
+	test := func(fls []*RefLine) {
+		for _, fl := range fls {
+			if fl.match(line) == nil {
+				continue
+			}
+			violated = true
+			if txs.OnForbidden != nil {
+				txs.OnForbidden(lno, orig, fl)
+			}
+		}
 	}
+	test(preamble(ref).Forbidden)
+	for i := range igbl {
+		for _, c := range igbl[i].cursors() {
+			for ; c.at != nil; c = *c.in {
+				if c.in == nil {
+					if c.set != nil {
+						test(c.at.forbid)
+					}
+					break
+				}
+				test(c.at.forbid)
+			}
+		}
+	}
+	return violated
 }
 
 func (txs *Texst) Check(reference RefDoc, subject io.Reader) (mismatchCount int, err error) {
-	igBacklog := make([]refLineQ, len(reference.IGroups()))
-	subjScan := bufio.NewScanner(subject)
+	enc, err := txs.encoding(reference)
+	if err != nil {
+		return 0, err
+	}
+	subject = decodeSubject(subject, enc)
+	igBacklog := make([]igState, len(reference.IGroups()))
+	pre := preamble(reference)
+	subjScan := newSubjectScanner(subject, pre.Continuation, txs.MaxLineLen)
+	subj := subjectReader{
+		scn:      subjScan,
+		rewrites: pre.Rewrites,
+		filters:  pre.Filters,
+	}
 	subjLine := 0
-	var mismatch []*RefLine
-	for subjScan.Scan() {
-		subjLine++
+	mc := matchCtx{
+		caps:   make(captures),
+		clock:  newClocks(),
+		labels: make(labels),
+		sync:   newSyncState(pre.Barriers),
+	}
+	dropped := make([]int, len(subj.filters))
+	defer txs.filtered(subj.filters, dropped)
+	for i, ig := range reference.IGroups() {
+		igBacklog[i].name = ig
+		igBacklog[i].policy = pre.Policies[ig]
+	}
+	if tmpls := pre.GroupTemplates; len(tmpls) > 0 {
+		for _, gt := range tmpls {
+			igBacklog[slices.Index(reference.IGroups(), gt.igName)].tmpl = gt
+		}
+		// Instances of template groups start at the first line of the group
+		if err = readIGBacklog(reference, igBacklog); err != nil {
+			return 0, err
+		}
+	}
+	if len(pre.Barriers) > 0 {
+		// Absent optional groups move to barrier lines that are not read yet
+		if err = readIGBacklog(reference, igBacklog); err != nil {
+			return 0, err
+		}
+	}
+	var plan []choice // Assignment of the next records found by search
+	budget := txs.SearchBudget
+	for {
+		rec, ok := subj.next()
+		if !ok {
+			break
+		}
+		var planned *choice
+		if len(plan) > 0 {
+			planned, plan = &plan[0], plan[1:]
+		}
+		subjLine = rec.lno
+		orig, line := rec.orig, rec.line
+		if rec.long {
+			mismatchCount++
+			txs.mismatch(subjLine, orig, nil)
+			txs.reason(subjLine, &LineLengthError{Max: txs.MaxLineLen})
+			if txs.MismatchLimit > 0 && mismatchCount >= txs.MismatchLimit {
+				break
+			}
+			continue
+		}
+		if txs.OnRewrite != nil && !bytes.Equal(orig, line) {
+			txs.OnRewrite(subjLine, orig, line)
+		}
+		if rec.filter >= 0 {
+			// Forbidden lines also apply to dropped lines
+			dropped[rec.filter]++
+			if txs.forbidden(subjLine, orig, line, reference, igBacklog) {
+				mismatchCount++
+			}
+			continue
+		}
+		refEOF := false
 		if err = fillIGBacklog(reference, igBacklog); errors.Is(err, io.EOF) {
-			txs.mismatch(subjLine, subjScan.Bytes(), nil)
-			return mismatchCount + 1, nil
+			refEOF = true
 		} else if err != nil {
 			return mismatchCount, err
 		}
+		mc.reset(line)
 		var (
-			matchLine  *RefLine
-			regexMatch []int
+			cs     []cursor
+			absent []rune
 		)
-		clear(mismatch)
-		mismatch = mismatch[:0]
-	IGOUP_LOOP:
-		for ig := range igBacklog {
-			igbl := &igBacklog[ig]
-			if igbl.empty() {
-				continue IGOUP_LOOP
-			}
-			refLine := igbl.first
-			regexMatch = refLine.match(subjScan.Bytes())
-			if regexMatch == nil {
-				mismatch = append(mismatch, refLine)
-				continue IGOUP_LOOP
-			}
-			fail := false
-			for i, seg := range refLine.masks {
-				if len(seg.checks) == 0 {
-					continue
-				}
-				segTxt := subjScan.Bytes()
-				segTxt = segTxt[regexMatch[2*i]:regexMatch[2*i+1]]
-				for _, check := range seg.checks {
-					if check.Check(segTxt) != nil {
-						fail = true
-						break
-					}
-				}
-
+		for i := range igBacklog {
+			ig := &igBacklog[i]
+			if ig.tmpl == nil && ig.policy.absent(ig.started) {
+				absent = append(absent, ig.name)
+				continue
+			}
+			cs = append(cs, ig.cursors()...)
+		}
+		mc.sync.update(cs, absent)
+		for i := range igBacklog {
+			if ig := &igBacklog[i]; ig.tmpl == nil {
+				c := mc.sync.release(ig.cursor(), ig.policy.absent(ig.started))
+				ig.commit(reference, c)
+			}
+		}
+		var ambiguous *AmbiguousError
+		if planned == nil && budget > 0 {
+			if ambiguous, plan, err = txs.search(&subj, &rec, reference, igBacklog, &mc, &budget); err != nil {
+				return mismatchCount, err
 			}
-			if fail {
-				mismatch = append(mismatch, refLine)
-			} else {
-				igbl.dropFirst()
-				matchLine = refLine
-				break IGOUP_LOOP
+			orig, line = rec.orig, rec.line
+			mc.line = line
+			if len(plan) > 0 {
+				planned, plan = &plan[0], plan[1:]
 			}
 		}
+		var (
+			matchLine  *RefLine
+			regexMatch []int
+		)
+		if planned != nil {
+			matchLine, regexMatch = stepPlanned(reference, igBacklog, &mc, *planned)
+		}
 		if matchLine == nil {
-			txs.mismatch(subjLine, subjScan.Bytes(), mismatch)
+			mc.skip = false
+			matchLine, regexMatch = step(reference, igBacklog, &mc)
+		}
+		if matchLine == nil {
+			// Only if no reference line matches, skip lines take the subject line
+			mc.skip = true
+			matchLine, regexMatch = step(reference, igBacklog, &mc)
+		}
+		if txs.forbidden(subjLine, orig, line, reference, igBacklog) {
 			mismatchCount++
+		}
+		if matchLine != nil {
+			mc.caps.bind(matchLine, subjLine, line, regexMatch)
+			mc.clock.bind(matchLine, subjLine, line, regexMatch)
+			mc.labels.bind(matchLine, subjLine)
+			if ambiguous == nil {
+				txs.match(subjLine, orig, line, matchLine, regexMatch)
+				continue
+			}
+			// The assignment of the line to a group is only a guess
+			mismatchCount++
+			txs.mismatch(subjLine, orig, ambiguous.Refs)
+			txs.reason(subjLine, ambiguous)
 			if txs.MismatchLimit > 0 && mismatchCount >= txs.MismatchLimit {
 				break
 			}
-		} else {
-			txs.match(subjLine, subjScan.Bytes(), matchLine, regexMatch)
-			reference.FreeLine(matchLine)
+			continue
+		}
+		mismatchCount++
+		if refEOF && len(mc.tried) == 0 {
+			txs.mismatch(subjLine, orig, nil)
+			txs.reasons(subjLine, &mc, igBacklog)
+			return mismatchCount, nil
+		}
+		txs.mismatch(subjLine, orig, mc.tried)
+		txs.reasons(subjLine, &mc, igBacklog)
+		if txs.MismatchLimit > 0 && mismatchCount >= txs.MismatchLimit {
+			break
 		}
 	}
+	if err = subjScan.Err(); err != nil {
+		return mismatchCount, err
+	}
+	subjLine = subjScan.end
 	if err = fillIGBacklog(reference, igBacklog); err != nil && !errors.Is(err, io.EOF) {
 		return mismatchCount, err
 	}
-	clear(mismatch)
-	mismatch = mismatch[:0]
-	for _, ig := range igBacklog {
-		if !ig.empty() {
-			mismatch = append(mismatch, ig.first)
+	var (
+		mismatch []*RefLine
+		reasons  []error
+	)
+	for i := range igBacklog {
+		ig := &igBacklog[i]
+		if ig.tmpl != nil {
+			optional := ig.policy&GroupOptional != 0 && len(ig.insts) == 0
+			if min, _ := ig.tmpl.Instances(); len(ig.insts) < min && !optional {
+				mismatch = append(mismatch, ig.first)
+				reasons = append(reasons, &InstanceError{
+					Template: ig.tmpl,
+					Count:    len(ig.insts),
+				})
+			}
+		}
+		for _, c := range ig.cursors() {
+			if ig.policy.complete(ig.started || ig.tmpl != nil) {
+				continue
+			}
+			if rl, reason := c.pending(); rl != nil {
+				mismatch = append(mismatch, rl)
+				if reason != nil {
+					reasons = append(reasons, reason)
+				}
+			}
 		}
 	}
 	if len(mismatch) > 0 {
 		txs.mismatch(subjLine+1, nil, mismatch)
+		for _, reason := range reasons {
+			txs.reason(subjLine+1, reason)
+		}
 		mismatchCount++
 	}
 	return mismatchCount, nil
 }
 
-func fillIGBacklog(ref RefDoc, igbl []refLineQ) error {
-	empty := 0
+// encoding returns the subject encoding for reference.
+func (txs *Texst) encoding(reference RefDoc) (string, error) {
+	enc := preamble(reference).Encoding
+	if enc == "" {
+		enc = EncUTF8
+	}
+	if txs.Encoding == "" {
+		return enc, nil
+	}
+	override, err := ParseEncoding(txs.Encoding)
+	if err != nil {
+		return "", err
+	}
+	if (enc == EncBytes) != (override == EncBytes) {
+		return "", fmt.Errorf("cannot override encoding '%s' of %s with '%s'",
+			enc,
+			reference.Name(),
+			override,
+		)
+	}
+	return override, nil
+}
+
+func (txs *Texst) reasons(lno int, mc *matchCtx, igbl []igState) {
+	if txs.OnReason == nil {
+		return
+	}
+	for _, reason := range mc.reasons {
+		txs.OnReason(lno, reason)
+	}
 	for i := range igbl {
-		if igbl[i].empty() {
-			empty++
+		ig := &igbl[i]
+		if ig.tmpl == nil {
+			if reason := ig.cursor().reason(mc.probe()); reason != nil {
+				txs.OnReason(lno, reason)
+			}
+			continue
+		}
+		for _, in := range ig.insts {
+			probe := mc.probe()
+			probe.key = &instanceKey{mask: ig.tmpl.key, value: in.key}
+			if reason := in.pos.reason(probe); reason != nil {
+				txs.OnReason(lno, reason)
+			}
 		}
 	}
-	for empty > 0 {
-		refLine, err := ref.NextLine()
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				return err
+}
+
+// RepeatError explains a mismatch that violates the number of repetitions of
+// a reference line or block.
+type RepeatError struct {
+	Ref   *RefLine
+	Count int // Number of times Ref was matched
+}
+
+func (e *RepeatError) Error() string {
+	min, max := e.Ref.Repeat()
+	if e.Count < min {
+		return fmt.Sprintf("%s:%d: matched %d times, expected at least %d",
+			e.Ref.SourceName(),
+			e.Ref.SourceLine(),
+			e.Count,
+			min,
+		)
+	}
+	return fmt.Sprintf("%s:%d: matches more than maximum of %d times",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+		max,
+	)
+}
+
+// UnorderedError explains a mismatch where lines of an unordered block did
+// not match.
+type UnorderedError struct {
+	Ref     *RefLine // The unordered block
+	Missing []*RefLine
+}
+
+func (e *UnorderedError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:%d: unordered block misses lines",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+	)
+	for i, rl := range e.Missing {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, " %d", rl.SourceLine())
+	}
+	return sb.String()
+}
+
+// CaptureError explains a mismatch where the value of a capturing mask
+// differs from the value that was bound by an earlier match.
+type CaptureError struct {
+	Ref       *RefLine
+	Name      rune
+	Value     string // The conflicting value from the subject line
+	Bound     string // The value bound by the earlier match
+	BoundLine int    // The subject line that bound the value
+}
+
+func (e *CaptureError) Error() string {
+	return fmt.Sprintf("%s:%d: mask '%c' has value '%s' but is bound to '%s' in line %d",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+		e.Name,
+		e.Value,
+		e.Bound,
+		e.BoundLine,
+	)
+}
+
+// CheckError explains a mismatch where a SegChecker of a mask rejected the
+// masked subject text.
+type CheckError struct {
+	Ref  *RefLine
+	Mask *Mask
+	Text string
+	Err  error
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%s:%d: check of mask '%c' failed: %s",
+		e.Ref.SourceName(),
+		e.Ref.SourceLine(),
+		e.Mask.Name(),
+		e.Err,
+	)
+}
+
+func (e *CheckError) Unwrap() error { return e.Err }
+
+// matchCtx is the context for matching a subject line with reference lines.
+type matchCtx struct {
+	line    []byte
+	skip    bool       // Only skip lines can take the line
+	tried   []*RefLine // Reference lines that did not match
+	reasons []error    // Reasons for mismatches that are not due to the text
+	caps    captures
+	clock   clocks
+	key     *instanceKey // Restricts matches of group template lines
+	labels  labels
+	sync    *syncState // Barriers are released without sync
+}
+
+func (mc *matchCtx) reset(line []byte) {
+	mc.line = line
+	mc.skip = false
+	mc.key = nil
+	clear(mc.tried)
+	mc.tried = mc.tried[:0]
+	clear(mc.reasons)
+	mc.reasons = mc.reasons[:0]
+}
+
+// probe returns a context to match the same subject line that does not record
+// tried lines and reasons of mc. Barriers do not block the probe.
+func (mc *matchCtx) probe() *matchCtx {
+	return &matchCtx{line: mc.line, caps: mc.caps, clock: mc.clock, labels: mc.labels}
+}
+
+func (mc *matchCtx) match(refLine *RefLine) []int {
+	regexMatch := refLine.match(mc.line)
+	if regexMatch == nil {
+		return nil
+	}
+	if mc.key != nil && !mc.key.accept(refLine, mc.line, regexMatch) {
+		return nil
+	}
+	for i, seg := range refLine.masks {
+		if len(seg.checks) == 0 {
+			continue
+		}
+		segTxt := refLine.segment(mc.line, regexMatch, i)
+		for _, check := range seg.checks {
+			if err := check.Check(segTxt); err != nil {
+				mc.reasons = append(mc.reasons, &CheckError{
+					Ref:  refLine,
+					Mask: seg,
+					Text: string(segTxt),
+					Err:  err,
+				})
+				return nil
 			}
-			if refLine == nil {
-				if empty == len(igbl) {
-					return io.EOF
+		}
+	}
+	if err := mc.caps.check(refLine, mc.line, regexMatch); err != nil {
+		mc.reasons = append(mc.reasons, err)
+		return nil
+	}
+	if err := mc.clock.check(refLine, mc.line, regexMatch); err != nil {
+		mc.reasons = append(mc.reasons, err)
+		return nil
+	}
+	if err := mc.labels.check(refLine); err != nil {
+		mc.reasons = append(mc.reasons, err)
+		return nil
+	}
+	return regexMatch
+}
+
+// captures are the values bound by capturing masks.
+type captures map[rune]capture
+
+type capture struct {
+	value string
+	line  int
+}
+
+// check returns a *CaptureError if a capturing mask of rl conflicts with
+// a bound value or with another capturing mask of the same name in rl.
+func (cs captures) check(rl *RefLine, line []byte, match []int) error {
+	for i, m := range rl.masks {
+		if !m.capture {
+			continue
+		}
+		val := rl.segment(line, match, i)
+		if c, ok := cs[m.name]; ok {
+			if c.value != string(val) {
+				return &CaptureError{
+					Ref:       rl,
+					Name:      m.name,
+					Value:     string(val),
+					Bound:     c.value,
+					BoundLine: c.line,
 				}
-				return nil
 			}
+			continue
+		}
+		for j, o := range rl.masks[:i] {
+			if !o.capture || o.name != m.name {
+				continue
+			}
+			if oval := rl.segment(line, match, j); !bytes.Equal(val, oval) {
+				return &CaptureError{
+					Ref:   rl,
+					Name:  m.name,
+					Value: string(val),
+					Bound: string(oval),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bind binds the values of the unbound capturing masks of the matched line
+// rl.
+func (cs captures) bind(rl *RefLine, lno int, line []byte, match []int) {
+	for i, m := range rl.masks {
+		if !m.capture {
+			continue
+		}
+		if _, ok := cs[m.name]; !ok {
+			cs[m.name] = capture{
+				value: string(rl.segment(line, match, i)),
+				line:  lno,
+			}
+		}
+	}
+}
+
+// step matches line with the reference lines in question of all interleaving
+// groups in the order of the groups. The first matching reference line is
+// returned.
+func step(ref RefDoc, igbl []igState, mc *matchCtx) (*RefLine, []int) {
+	for i := range igbl {
+		ig := &igbl[i]
+		if ig.tmpl != nil {
+			if rl, match := ig.stepInstances(mc); rl != nil {
+				return rl, match
+			}
+			continue
+		}
+		if next, rl, match := ig.cursor().step(mc); rl != nil {
+			mc.sync.pass(ig.cursor(), next)
+			ig.commit(ref, next)
+			ig.start(rl)
+			return rl, match
+		}
+	}
+	return nil, nil
+}
+
+// stepPlanned matches the subject line with the reference lines in question
+// of the interleaving group planned by search.
+func stepPlanned(ref RefDoc, igbl []igState, mc *matchCtx, planned choice) (*RefLine, []int) {
+	if planned.ig < 0 {
+		return nil, nil
+	}
+	ig := &igbl[planned.ig]
+	mc.skip = planned.skip
+	next, rl, match := ig.cursor().step(mc)
+	if rl != nil {
+		mc.sync.pass(ig.cursor(), next)
+		ig.commit(ref, next)
+		ig.start(rl)
+	}
+	return rl, match
+}
+
+// search searches an assignment of the subject record rec and the records
+// after rec to interleaving groups if rec matches reference lines of several
+// interleaving groups. The backtracks of the search are subtracted from
+// budget. The result ambiguous is not nil if the search exceeds the budget.
+// Because search reads ahead, rec is changed to not use the buffer of the
+// subject scanner.
+func (txs *Texst) search(
+	subj *subjectReader,
+	rec *subjectRecord,
+	ref RefDoc,
+	igbl []igState,
+	mc *matchCtx,
+	budget *int,
+) (ambiguous *AmbiguousError, plan []choice, err error) {
+	if len(preamble(ref).GroupTemplates) > 0 {
+		return nil, nil, nil
+	}
+	if err = readIGBacklog(ref, igbl); err != nil {
+		return nil, nil, err
+	}
+	st := newSearchState(igbl, mc)
+	alts := st.alternatives(rec.line)
+	if len(alts) < 2 {
+		return nil, nil, nil
+	}
+	rec.orig = bytes.Clone(rec.orig)
+	rec.line = bytes.Clone(rec.line)
+	plan, exceeded := search(subj, *rec, igbl, mc, budget)
+	if exceeded {
+		ambiguous = &AmbiguousError{Budget: txs.SearchBudget}
+		for _, alt := range alts {
+			ambiguous.Refs = append(ambiguous.Refs, alt.ref)
+		}
+	}
+	return ambiguous, plan, nil
+}
+
+// fillIGBacklog reads reference lines until each interleaving group has a
+// mandatory line behind its first line. It returns io.EOF when the reference
+// has no more lines.
+func fillIGBacklog(ref RefDoc, igbl []igState) error {
+	need := 0
+	for i := range igbl {
+		if igbl[i].needsLine() {
+			need++
+		}
+	}
+	for need > 0 {
+		refLine, err := ref.NextLine()
+		if err != nil {
+			return err
 		}
 		igIdx := slices.Index(ref.IGroups(), refLine.igName)
 		if igIdx < 0 {
-			return lineErrorf(ref, "unknown interleaving group: %c", refLine.igName)
-		}
-		if igbl[igIdx].empty() {
-			empty--
+			return lineErrorf(ref, "unknown interleaving group: %s", refLine.IGroupName())
 		}
+		needed := igbl[igIdx].needsLine()
 		igbl[igIdx].pushBack(refLine)
+		if needed && !igbl[igIdx].needsLine() {
+			need--
+		}
 	}
 	return nil
 }
 
+// readIGBacklog reads all remaining reference lines into the backlogs of
+// their interleaving groups.
+func readIGBacklog(ref RefDoc, igbl []igState) error {
+	for {
+		refLine, err := ref.NextLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		igIdx := slices.Index(ref.IGroups(), refLine.igName)
+		if igIdx < 0 {
+			return lineErrorf(ref, "unknown interleaving group: %s", refLine.IGroupName())
+		}
+		igbl[igIdx].pushBack(refLine)
+	}
+}
+
+// GroupPolicy controls which reference lines of an interleaving group must
+// match when the subject ends. Policies can be combined.
+type GroupPolicy uint8
+
+const (
+	// The group may be absent from the subject. Once a line of the group
+	// matched, all of its lines must match. For group templates, there may be
+	// no instances at all.
+	GroupOptional GroupPolicy = 1 << iota
+	// Once a line of the group matched, the subject may end anywhere in the
+	// group, e.g. because the process was killed.
+	GroupTruncate
+
+	// All lines of the group must match. This is the default.
+	GroupStrict GroupPolicy = 0
+)
+
+var groupPolicyNames = flagNames[GroupPolicy]{
+	what: "group policy",
+	zero: "strict",
+	bits: []string{"optional", "truncate"},
+}
+
+// ParseGroupPolicy parses group policy names "optional" and "truncate"
+// separated by spaces or commas. The name "strict" resets the policy.
+func ParseGroupPolicy(s string) (GroupPolicy, error) { return groupPolicyNames.parse(s) }
+
+func (p GroupPolicy) String() string { return groupPolicyNames.format(p) }
+
+// complete reports if a group with policy p needs no more matches at the end
+// of the subject without looking at its pending lines. Started tells if a
+// line of the group matched.
+func (p GroupPolicy) complete(started bool) bool {
+	if started {
+		return p&GroupTruncate != 0
+	}
+	return p&GroupOptional != 0
+}
+
+// absent reports if a group with policy p may be absent because it did not
+// start.
+func (p GroupPolicy) absent(started bool) bool {
+	return !started && p&GroupOptional != 0
+}
+
+// final reports if c is final at the end of the subject for a group with
+// policy p.
+func (p GroupPolicy) final(c cursor, started bool) bool {
+	return p.complete(started) || c.final()
+}
+
+// igState is the backlog of reference lines of an interleaving group together
+// with the matching state of its first line.
+type igState struct {
+	refLineQ
+	pos     cursor
+	tmpl    *GroupTemplate // Lines of template groups are never freed
+	insts   []instance     // Instances of a template group
+	name    rune
+	policy  GroupPolicy
+	started bool // A line of the group other than a skip line matched
+}
+
+// start records that ig started if the matching line rl is not a skip line.
+func (ig *igState) start(rl *RefLine) {
+	if rl.kind != skipLine {
+		ig.started = true
+	}
+}
+
+func (ig *igState) needsLine() bool {
+	return ig.first == ig.last || ig.last.min == 0 || ig.last.emptyRep()
+}
+
+func (ig *igState) cursor() cursor {
+	c := ig.pos
+	c.at = ig.first
+	return c
+}
+
+// commit sets the state of ig to c. All lines in front of c are freed.
+func (ig *igState) commit(ref RefDoc, c cursor) {
+	for ig.first != c.at {
+		drop := ig.first
+		ig.dropFirst()
+		ref.FreeLine(drop)
+	}
+	ig.pos = c
+}
+
+// cursor is the matching state within a sequence of reference lines, i.e. the
+// lines of an interleaving group or the lines of a block.
+type cursor struct {
+	at    *RefLine  // The current line
+	count int       // Number of matches of at, completed repetitions for blocks
+	in    *cursor   // Progress within the current repetition of block at
+	set   *setState // Matching state of the current repetition of unordered block at
+}
+
+// step returns the cursor after matching the subject line with the lines in
+// question from c on. The result ref is nil if no line matches.
+//
+// Reference lines are repeated as often as possible before the next line is
+// tried. Skip lines skip as few lines as possible.
+func (c cursor) step(mc *matchCtx) (next cursor, ref *RefLine, match []int) {
+	if c.at == nil {
+		return c, nil, nil
+	}
+	if c.in != nil {
+		if in, ref, match := c.in.step(mc); ref != nil {
+			c.in = &in
+			return c, ref, match
+		}
+		if !c.in.final() {
+			return c, nil, nil
+		}
+		c.in = nil
+		c.count++
+	}
+	if c.set != nil {
+		if !mc.skip {
+			if set, ref, match := setStep(c.at, c.set, mc); ref != nil {
+				c.set = set
+				return c, ref, match
+			}
+		}
+		if setMissing(c.at, c.set) != nil {
+			return c, nil, nil
+		}
+		c.set = nil
+		c.count++
+	}
+	if c.at.kind == barrierLine && !mc.sync.released(c.at.text) {
+		if mc.sync != nil && !mc.skip {
+			// Explain the mismatch if a line behind the barrier matches
+			if _, rl, _ := (cursor{at: c.at.lsNext}).step(mc.probe()); rl != nil {
+				mc.reasons = append(mc.reasons, mc.sync.blocked(rl, c.at.text))
+			}
+		}
+		return c, nil, nil
+	}
+	if c.at.mayRepeat(c.count) {
+		switch c.at.kind {
+		case textLine:
+			if !mc.skip {
+				if match = mc.match(c.at); match != nil {
+					c.count++
+					return c, c.at, match
+				}
+				mc.tried = append(mc.tried, c.at)
+			}
+		case skipLine:
+			if mc.skip {
+				c.count++
+				return c, c.at, []int{0, len(mc.line)}
+			}
+		case blockLine:
+			start := cursor{at: c.at.sub}
+			if in, ref, match := start.step(mc); ref != nil {
+				c.in = &in
+				return c, ref, match
+			}
+		case setLine:
+			if !mc.skip {
+				if set, ref, match := setStep(c.at, newSetState(c.at), mc); ref != nil {
+					c.set = set
+					return c, ref, match
+				}
+			}
+		}
+	}
+	if c.count < c.at.min && !c.at.emptyRep() {
+		return c, nil, nil
+	}
+	return cursor{at: c.at.lsNext}.step(mc)
+}
+
+// emptyRep reports if a repetition of the block rl can match no subject line
+// because all lines of the block are optional.
+func (rl *RefLine) emptyRep() bool {
+	switch rl.kind {
+	case blockLine:
+		return cursor{at: rl.sub}.final()
+	case setLine:
+		return setMissing(rl, newSetState(rl)) == nil
+	}
+	return false
+}
+
+func (c cursor) final() bool {
+	rl, _ := c.pending()
+	return rl == nil
+}
+
+// pending returns the first line from c on that is missing a match. If the
+// line was already matched but too few times, reason explains the mismatch.
+func (c cursor) pending() (rl *RefLine, reason error) {
+	for ; c.at != nil; c = (cursor{at: c.at.lsNext}) {
+		count := c.count
+		if c.in != nil {
+			if rl, reason = c.in.pending(); rl != nil {
+				return rl, reason
+			}
+			count++
+		}
+		if c.set != nil {
+			if missing := setMissing(c.at, c.set); missing != nil {
+				return missing[0], &UnorderedError{Ref: c.at, Missing: missing}
+			}
+			count++
+		}
+		if count < c.at.min && !c.at.emptyRep() {
+			if count > 0 {
+				reason = &RepeatError{Ref: c.at, Count: count}
+			}
+			return c.at, reason
+		}
+	}
+	return nil, nil
+}
+
+// reason explains why the subject line of the probe context mc does not match
+// at c if this is due to the number of repetitions of the current line or due
+// to missing lines of an unordered block.
+func (c cursor) reason(mc *matchCtx) error {
+	if c.at == nil {
+		return nil
+	}
+	if c.in != nil {
+		if err := c.in.reason(mc); err != nil || !c.in.final() {
+			return err
+		}
+		c.count++
+	}
+	if c.set != nil {
+		if missing := setMissing(c.at, c.set); missing != nil {
+			return &UnorderedError{Ref: c.at, Missing: missing}
+		}
+		c.count++
+	}
+	switch {
+	case c.count == 0:
+		return nil
+	case c.count < c.at.min && !c.at.emptyRep():
+		return &RepeatError{Ref: c.at, Count: c.count}
+	case c.at.mayRepeat(c.count):
+		return nil
+	}
+	switch c.at.kind {
+	case textLine:
+		if mc.match(c.at) == nil {
+			return nil
+		}
+	case blockLine:
+		if _, rl, _ := (cursor{at: c.at.sub}).step(mc); rl == nil {
+			return nil
+		}
+	case setLine:
+		if _, rl, _ := setStep(c.at, newSetState(c.at), mc); rl == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return &RepeatError{Ref: c.at, Count: c.count + 1}
+}
+
+// setState is the matching state of the current repetition of an unordered
+// block. Each matched subject line is assigned to one line of the block. To
+// match a new subject line, earlier subject lines can be assigned to other
+// lines of the block they also match. A setState is not modified once it is
+// part of a cursor.
+type setState struct {
+	counts []int       // Matches per line of the block
+	lines  []setAssign // The matched subject lines
+}
+
+// setAssign is the assignment of a subject line to a line of an unordered
+// block.
+type setAssign struct {
+	cands []int // Indices of the block lines that match the subject line
+	to    int   // Index of the assigned block line
+}
+
+func newSetState(blk *RefLine) *setState {
+	return &setState{counts: make([]int, blk.blockLen())}
+}
+
+func (st *setState) clone() *setState {
+	return &setState{
+		counts: slices.Clone(st.counts),
+		lines:  slices.Clone(st.lines),
+	}
+}
+
+// move assigns the subject line j to the block line to.
+func (st *setState) move(j, to int) {
+	if from := st.lines[j].to; from >= 0 {
+		st.counts[from]--
+	}
+	st.lines[j].to = to
+	st.counts[to]++
+}
+
+// assign assigns the subject line j to one of its candidates that may match
+// once more. Other subject lines are assigned to other candidates if needed.
+// The block lines in seen are not considered.
+func (st *setState) assign(blk []*RefLine, j int, seen []bool) bool {
+	for _, m := range st.lines[j].cands {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		if blk[m].mayRepeat(st.counts[m]) {
+			st.move(j, m)
+			return true
+		}
+		for k := range st.lines {
+			if k != j && st.lines[k].to == m && st.assign(blk, k, seen) {
+				st.move(j, m)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fill assigns one more subject line to the block line m. The subject line is
+// taken from a block line that has more matches than needed, possibly by
+// reassigning further subject lines. The block lines in seen are not
+// considered.
+func (st *setState) fill(blk []*RefLine, m int, seen []bool) bool {
+	seen[m] = true
+	for k, sl := range st.lines {
+		o := sl.to
+		if o == m || seen[o] || !slices.Contains(sl.cands, m) {
+			continue
+		}
+		if st.counts[o] > blk[o].min || st.fill(blk, o, seen) {
+			st.move(k, m)
+			return true
+		}
+	}
+	return false
+}
+
+// setStep matches line with the lines of the unordered block blk. The subject
+// line is assigned to a line of the block as described for setState. It
+// returns the updated copy of st.
+func setStep(blk *RefLine, st *setState, mc *matchCtx) (next *setState, ref *RefLine, match []int) {
+	lines := blk.Block()
+	var (
+		cands   []int
+		matches [][]int
+	)
+	for i, rl := range lines {
+		if m := mc.match(rl); m != nil {
+			cands = append(cands, i)
+			matches = append(matches, m)
+		} else if rl.mayRepeat(st.counts[i]) {
+			mc.tried = append(mc.tried, rl)
+		}
+	}
+	if len(cands) == 0 {
+		return st, nil, nil
+	}
+	next = st.clone()
+	next.lines = append(next.lines, setAssign{cands: cands, to: -1})
+	if !next.assign(lines, len(next.lines)-1, make([]bool, len(lines))) {
+		return st, nil, nil
+	}
+	to := next.lines[len(next.lines)-1].to
+	return next, lines[to], matches[slices.Index(cands, to)]
+}
+
+// setMissing returns the lines of the unordered block blk that did not match
+// often enough according to st. Subject lines are reassigned to other lines
+// of the block if this reduces the missing lines.
+func setMissing(blk *RefLine, st *setState) (missing []*RefLine) {
+	lines := blk.Block()
+	bal := st
+	for i, rl := range lines {
+		for bal.counts[i] < rl.min {
+			if bal == st {
+				bal = st.clone()
+			}
+			if !bal.fill(lines, i, make([]bool, len(lines))) {
+				break
+			}
+		}
+	}
+	st = bal
+	for i, rl := range lines {
+		if st.counts[i] < rl.min {
+			missing = append(missing, rl)
+		}
+	}
+	return missing
+}
+
 type refLineQ struct{ first, last *RefLine }
 
 func (b *refLineQ) empty() bool { return b.first == nil }
@@ -1,7 +1,9 @@
 package texst
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"slices"
 	"strings"
 	"testing"
@@ -20,7 +22,7 @@ func ExampleTexst() {
 		OnMismatch: func(tiLNo int, tiLine []byte, _ []*RefLine) {
 			fmt.Printf("input:%d [%s]\n", tiLNo, tiLine)
 		},
-		OnMatch: func(tiLNo int, line []byte, _ *RefLine, match []int) {
+		OnMatch: func(tiLNo int, line, _ []byte, _ *RefLine, match []int) {
 			txt := func(i int) string {
 				i *= 2
 				part := line[match[i]:match[i+1]]
@@ -46,79 +48,98 @@ func ExampleTexst() {
 	// 0 mismatches
 }
 
-func TestTexst_maskTypes(t *testing.T) {
-	check := func(t *testing.T, ref, subj string, mm int) {
-		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
-		mmn := testerr.Shall1((&Texst{}).Check(refRd, strings.NewReader(subj))).BeNil(t)
-		if mmn != mm {
-			t.Errorf("expect %d, detected %d mismatches [%s]", mm, mmn, subj)
+// checkRef checks subj against the reference text ref and reports an error
+// unless there are mm mismatches. It returns the reasons of the mismatches
+// with their subject line numbers.
+func checkRef(t *testing.T, ref, subj string, mm int) (reasons []string) {
+	t.Helper()
+	return checkWith(t, Texst{}, ref, subj, mm)
+}
+
+// checkWith is checkRef with the callbacks and settings of txs and the
+// options opts for the reference. It only records the reasons if txs has no
+// OnReason callback.
+func checkWith(t *testing.T, txs Texst, ref, subj string, mm int, opts ...RefOption) (reasons []string) {
+	t.Helper()
+	refRd := testerr.Shall1(NewRefString(t.Name(), ref, opts...)).BeNil(t)
+	if txs.OnReason == nil {
+		txs.OnReason = func(testedNo int, reason error) {
+			reasons = append(reasons, fmt.Sprintf("%d %s", testedNo, reason))
 		}
 	}
+	mmn := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+	if mmn != mm {
+		t.Errorf("expect %d, detected %d mismatches [%q]", mm, mmn, subj)
+	}
+	return reasons
+}
+
+func TestTexst_maskTypes(t *testing.T) {
 
 	t.Run("fix", func(t *testing.T) {
 		const ref = `> foo bar baz
  .    xxx`
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XX baz", 2)
-		check(t, ref, "foo XXXX baz", 2)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XX baz", 2)
+		checkRef(t, ref, "foo XXXX baz", 2)
 	})
 	t.Run("0 or more", func(t *testing.T) {
 		const ref = `> foo bar baz
  *    xxx`
-		check(t, ref, "foo  baz", 0)
-		check(t, ref, "foo X baz", 0)
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XXXX baz", 0)
+		checkRef(t, ref, "foo  baz", 0)
+		checkRef(t, ref, "foo X baz", 0)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XXXX baz", 0)
 	})
 	t.Run("1 or more", func(t *testing.T) {
 		const ref = `> foo bar baz
  +    xxx`
-		check(t, ref, "foo  baz", 2)
-		check(t, ref, "foo X baz", 0)
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XXXX baz", 0)
+		checkRef(t, ref, "foo  baz", 2)
+		checkRef(t, ref, "foo X baz", 0)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XXXX baz", 0)
 	})
 	t.Run("0 up to mask", func(t *testing.T) {
 		const ref = `> foo bar baz
  0    xxx`
-		check(t, ref, "foo  baz", 0)
-		check(t, ref, "foo X baz", 0)
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XXXX baz", 2)
+		checkRef(t, ref, "foo  baz", 0)
+		checkRef(t, ref, "foo X baz", 0)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XXXX baz", 2)
 	})
 
 	t.Run("1 up to mask", func(t *testing.T) {
 		const ref = `> foo bar baz
  1    xxx`
-		check(t, ref, "foo  baz", 2)
-		check(t, ref, "foo X baz", 0)
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XXXX baz", 2)
+		checkRef(t, ref, "foo  baz", 2)
+		checkRef(t, ref, "foo X baz", 0)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XXXX baz", 2)
 	})
 	t.Run("at least mask", func(t *testing.T) {
 		const ref = `> foo bar baz
  -    xxx`
-		check(t, ref, "foo  baz", 2)
-		check(t, ref, "foo XX baz", 2)
-		check(t, ref, "foo XXX baz", 0)
-		check(t, ref, "foo XXXX baz", 0)
+		checkRef(t, ref, "foo  baz", 2)
+		checkRef(t, ref, "foo XX baz", 2)
+		checkRef(t, ref, "foo XXX baz", 0)
+		checkRef(t, ref, "foo XXXX baz", 0)
 	})
 	t.Run("char class", func(t *testing.T) {
 		const ref = `> foo bar baz
  .    xxx
  ?x \d`
-		check(t, ref, "foo abc baz", 2)
-		check(t, ref, "foo 123 baz", 0)
-		check(t, ref, "foo 1_3 baz", 2)
+		checkRef(t, ref, "foo abc baz", 2)
+		checkRef(t, ref, "foo 123 baz", 0)
+		checkRef(t, ref, "foo 1_3 baz", 2)
 	})
 	t.Run("match", func(t *testing.T) {
 		const ref = `> foo bar baz
  .    xxx
  ~x \d{3}`
-		check(t, ref, "foo 12 baz", 2)
-		check(t, ref, "foo 123 baz", 0)
-		check(t, ref, "foo 1_3 baz", 2)
-		check(t, ref, "foo 1234 baz", 2)
+		checkRef(t, ref, "foo 12 baz", 2)
+		checkRef(t, ref, "foo 123 baz", 0)
+		checkRef(t, ref, "foo 1_3 baz", 2)
+		checkRef(t, ref, "foo 1234 baz", 2)
 	})
 }
 
@@ -175,3 +196,899 @@ line 4`,
 		t.Error("unexpected mismatch")
 	}
 }
+
+func TestTexst_skip(t *testing.T) {
+	check := func(t *testing.T, ref, subj string) (mmLines []string) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		txs := Texst{OnMismatch: func(testedNo int, testedLine []byte, ref []*RefLine) {
+			mmLines = append(mmLines, fmt.Sprintf("%d %s %d",
+				testedNo,
+				testedLine,
+				len(ref),
+			))
+		}}
+		testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+		return mmLines
+	}
+	t.Run("exact", func(t *testing.T) {
+		const ref = "> a\nskip 2\n> d"
+		if mm := check(t, ref, "a\nb\nc\nd"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nb\nd"); !slices.Equal(mm, []string{"4  1"}) {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nb\nc\nx\nd"); !slices.Equal(mm, []string{"4 x 1"}) {
+			t.Error("mismatches", mm)
+		}
+	})
+	t.Run("range", func(t *testing.T) {
+		const ref = "> a\nskip 1..2\n> d"
+		if mm := check(t, ref, "a\nb\nd"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nb\nc\nd"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nd"); !slices.Equal(mm, []string{"3  1"}) {
+			t.Error("mismatches", mm)
+		}
+	})
+	t.Run("any", func(t *testing.T) {
+		const ref = "skip *\n> d\nskip *"
+		if mm := check(t, ref, "d"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nb\nd\ne"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+		if mm := check(t, ref, "a\nb"); !slices.Equal(mm, []string{"3  1"}) {
+			t.Error("mismatches", mm)
+		}
+	})
+	t.Run("igroups", func(t *testing.T) {
+		const ref = "%%12\n>1a\nskip1 *\n>1d\n>2b\n>2c"
+		if mm := check(t, ref, "a\nx\nb\ny\nc\nd"); len(mm) != 0 {
+			t.Error("mismatches", mm)
+		}
+	})
+}
+
+func TestTexst_optional(t *testing.T) {
+	t.Run("inner", func(t *testing.T) {
+		const ref = "> a\n? b\n? c\n> d"
+		checkRef(t, ref, "a\nb\nc\nd", 0)
+		checkRef(t, ref, "a\nc\nd", 0)
+		checkRef(t, ref, "a\nd", 0)
+		checkRef(t, ref, "a\nc\nb\nd", 1)
+	})
+	t.Run("last", func(t *testing.T) {
+		const ref = "> a\n? b"
+		checkRef(t, ref, "a", 0)
+		checkRef(t, ref, "a\nb", 0)
+		checkRef(t, ref, "a\nc", 1)
+	})
+	t.Run("before skip", func(t *testing.T) {
+		const ref = "> a\n? b\nskip\n> d"
+		checkRef(t, ref, "a\nb\nc\nd", 0)
+		checkRef(t, ref, "a\nc\nd", 0)
+		checkRef(t, ref, "a\nd", 1)
+	})
+	t.Run("igroups", func(t *testing.T) {
+		const ref = "%%12\n>1a\n?1b\n>1c\n>2b"
+		checkRef(t, ref, "a\nb\nb\nc", 0)
+		checkRef(t, ref, "a\nc\nb", 0)
+	})
+}
+
+func TestTexst_repeat(t *testing.T) {
+	t.Run("line", func(t *testing.T) {
+		const ref = "> a\n> step 1\n .     x\n {2,3}\n> b"
+		checkRef(t, ref, "a\nstep 1\nstep 2\nb", 0)
+		checkRef(t, ref, "a\nstep 1\nstep 2\nstep 3\nb", 0)
+		rs := checkRef(t, ref, "a\nstep 1\nb", 2)
+		if !slices.Equal(rs, []string{
+			"3 TestTexst_repeat/line:2: matched 1 times, expected at least 2",
+			"4 TestTexst_repeat/line:2: matched 1 times, expected at least 2",
+		}) {
+			t.Error("reasons", rs)
+		}
+		rs = checkRef(t, ref, "a\nstep 1\nstep 2\nstep 3\nstep 4\nb", 1)
+		if !slices.Equal(rs, []string{"5 TestTexst_repeat/line:2: matches more than maximum of 3 times"}) {
+			t.Error("reasons", rs)
+		}
+	})
+	t.Run("unbounded", func(t *testing.T) {
+		const ref = "> a\n {1,}"
+		checkRef(t, ref, "a", 0)
+		checkRef(t, ref, "a\na\na\na", 0)
+		checkRef(t, ref, "a\nb", 1)
+	})
+	t.Run("block", func(t *testing.T) {
+		const ref = "> a\n(\n> b\n? c\n> d\n){2}\n> e"
+		checkRef(t, ref, "a\nb\nd\nb\nc\nd\ne", 0)
+		rs := checkRef(t, ref, "a\nb\nd\ne", 2)
+		if !slices.Equal(rs, []string{
+			"4 TestTexst_repeat/block:2: matched 1 times, expected at least 2",
+			"5 TestTexst_repeat/block:2: matched 1 times, expected at least 2",
+		}) {
+			t.Error("reasons", rs)
+		}
+		rs = checkRef(t, ref, "a\nb\nd\nb\nd", 1)
+		if !slices.Equal(rs, nil) {
+			t.Error("reasons", rs)
+		}
+	})
+	t.Run("nested block", func(t *testing.T) {
+		const ref = "(\n> a\n(\n> b\n){1,2}\n){1,}"
+		checkRef(t, ref, "a\nb\na\nb\nb", 0)
+		checkRef(t, ref, "a\nb\nb\nb", 1)
+	})
+	t.Run("optional block", func(t *testing.T) {
+		const ref = "> start\n(\n? retry\n? backoff\n)\n> done"
+		checkRef(t, ref, "start\ndone", 0)
+		checkRef(t, ref, "start\nretry\nbackoff\ndone", 0)
+		checkRef(t, ref, "start\nretry\nretry\ndone", 1)
+		checkRef(t, ref, "start", 1)
+	})
+}
+
+func Test_parseRepeat(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		min, max int
+	}{
+		{"{3}", 3, 3},
+		{"{0,1}", 0, 1},
+		{"{2,}", 2, -1},
+	} {
+		min, max, err := parseRepeat(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("repeat '%s': %d..%d, want %d..%d", test.s, min, max, test.min, test.max)
+		}
+	}
+	for _, s := range []string{"3", "{0}", "{3,2}", "{x}", "{1,2"} {
+		if _, _, err := parseRepeat(s); err == nil {
+			t.Errorf("no error for repeat '%s'", s)
+		}
+	}
+}
+
+func TestTexst_unordered(t *testing.T) {
+	const ref = "> start\n[\n> a=1\n .  x\n> b=2\n .  x\n? c=3\n]\n> end"
+	checkRef(t, ref, "start\na=7\nb=8\nend", 0)
+	checkRef(t, ref, "start\nb=8\na=7\nend", 0)
+	checkRef(t, ref, "start\nc=3\nb=8\na=7\nend", 0)
+	checkRef(t, ref, "start\nb=8\nb=8\na=7\nend", 1)
+	rs := checkRef(t, ref, "start\nb=8\nend", 2)
+	if !slices.Equal(rs, []string{
+		"3 TestTexst_unordered:2: unordered block misses lines 3",
+		"4 TestTexst_unordered:2: unordered block misses lines 3",
+	}) {
+		t.Error("reasons", rs)
+	}
+	t.Run("repeat", func(t *testing.T) {
+		const ref = "[\n> a\n> b\n]{2}"
+		checkRef(t, ref, "a\nb\nb\na", 0)
+		checkRef(t, ref, "a\nb\nb\nb", 2)
+	})
+	t.Run("overlapping masks", func(t *testing.T) {
+		const ref = "[\n> xx\n +xx\n> ab\n]"
+		checkRef(t, ref, "ab\nzz", 0)
+		checkRef(t, ref, "zz\nab", 0)
+		checkRef(t, ref, "zz\nyy", 2)
+		const rep = "[\n> xx\n +xx\n {1,2}\n> ab\n]"
+		checkRef(t, rep, "ab\nab", 0)
+		checkRef(t, rep, "ab\nzz\nab", 0)
+		checkRef(t, rep, "zz\nzz", 1)
+	})
+	t.Run("optional lines", func(t *testing.T) {
+		const ref = "> start\n[\n? x\n? y\n]\n> done"
+		checkRef(t, ref, "start\ndone", 0)
+		checkRef(t, ref, "start\ny\ndone", 0)
+		checkRef(t, ref, "start\ny\nx\ndone", 0)
+		checkRef(t, ref, "start\ny\ny\ndone", 1)
+	})
+}
+
+func TestTexst_capture(t *testing.T) {
+	const ref = `> start id=0000
+ .         iiii
+ =i
+> work
+> done id=0000
+ .        iiii
+ =i`
+	checkRef(t, ref, "start id=1234\nwork\ndone id=1234", 0)
+	rs := checkRef(t, ref, "start id=1234\nwork\ndone id=4321", 2)
+	if !slices.Equal(rs, []string{
+		"3 TestTexst_capture:5: mask 'i' has value '4321' but is bound to '1234' in line 1",
+	}) {
+		t.Error("reasons", rs)
+	}
+	t.Run("global", func(t *testing.T) {
+		const ref = "*.   ddd\n*=d\n> a: xxx\n> b: xxx"
+		checkRef(t, ref, "a: tmp\nb: tmp", 0)
+		checkRef(t, ref, "a: tmp\nb: foo", 2)
+	})
+	t.Run("same line", func(t *testing.T) {
+		const ref = "> x=aa y=aa\n .  aa   aa\n =a"
+		checkRef(t, ref, "x=12 y=12", 0)
+		checkRef(t, ref, "x=12 y=21", 2)
+	})
+	t.Run("after groups", func(t *testing.T) {
+		const ref = "> m c\n .m c\n ~m (a|b)\n =c\n> c\n .c\n =c"
+		checkRef(t, ref, "b x\nx", 0)
+		checkRef(t, ref, "b x\ny", 2)
+	})
+}
+
+func TestTexst_timestamp(t *testing.T) {
+	const ref = `*.TTTTTTTT
+*^T TimeOnly
+> 00:00:00 start
+ &T s
+> 00:00:00 work
+> 00:00:00 done
+ <T s 2s`
+	checkRef(t, ref, "10:00:00 start\n10:00:00 work\n10:00:02 done", 0)
+	rs := checkRef(t, ref, "10:00:00 start\n09:59:59 work\n10:00:02 done", 3)
+	if len(rs) == 0 || rs[0] != "2 TestTexst_timestamp:5: check of mask 'T' failed: time 09:59:59 before 10:00:00 in line 1" {
+		t.Error("reasons", rs)
+	}
+	rs = checkRef(t, ref, "10:00:00 start\n10:00:01 work\n10:00:05 done", 2)
+	if len(rs) == 0 || rs[0] != "3 TestTexst_timestamp:6: check of mask 'T' failed: gap to time mark 's' in line 1: 5s greater than 2s" {
+		t.Error("reasons", rs)
+	}
+	rs = checkRef(t, ref, "10:00:00 start\n10:00:01 work\n10:61:05 done", 2)
+	if len(rs) == 0 || rs[0] != "3 TestTexst_timestamp:6: check of mask 'T' failed: not a time '15:04:05': 10:61:05" {
+		t.Error("reasons", rs)
+	}
+	t.Run("igroup", func(t *testing.T) {
+		const ref = "%%12\n*.  TT\n*^T igroup 05\n>1a 00\n>1b 00\n>2c 00\n>2d 00"
+		checkRef(t, ref, "a 10\nc 05\nb 11\nd 06", 0)
+		checkRef(t, ref, "a 10\nc 05\nb 09\nd 06", 2)
+	})
+	t.Run("no order", func(t *testing.T) {
+		const ref = "*.TT\n*^T none 05\n> 00 a\n &T x\n> 00 b\n <T x -5s..5s"
+		checkRef(t, ref, "10 a\n07 b", 0)
+		checkRef(t, ref, "10 a\n17 b", 2)
+	})
+	t.Run("after groups", func(t *testing.T) {
+		const ref = "> m 00\n .m TT\n ~m (a|b)\n ^T none 05\n &T x\n> 00\n .TT\n ^T none 05\n <T x 0s..5s"
+		checkRef(t, ref, "a 10\n12", 0)
+		checkRef(t, ref, "a 10\n30", 2)
+	})
+}
+
+func TestTexst_space(t *testing.T) {
+	t.Run("collapse", func(t *testing.T) {
+		const ref = "@space collapse\n> name    size\n> foo  0   end\n +     x"
+		checkRef(t, ref, "name size\nfoo 12345\tend", 0)
+		checkRef(t, ref, "name size\nfoo 12345end", 2)
+		checkRef(t, ref, "namesize\nfoo 1 end", 3)
+	})
+	t.Run("trailing leading", func(t *testing.T) {
+		const ref = "> a b  \n _trailing\n>   c\n _leading\n>  d\n _trailing, leading"
+		checkRef(t, ref, "a b\n\t c\nd ", 0)
+		checkRef(t, ref, "a b   \nc\n  d", 0)
+		checkRef(t, ref, "a  b\nc\nd", 4)
+	})
+	t.Run("exact", func(t *testing.T) {
+		const ref = "@space collapse\n> a  b\n _exact\n> c  d"
+		checkRef(t, ref, "a  b\nc d", 0)
+		checkRef(t, ref, "a b\nc d", 3)
+	})
+}
+
+func TestTexst_foldCase(t *testing.T) {
+	t.Run("document", func(t *testing.T) {
+		const ref = "@case fold\n> INFO start\n@case exact\n> done"
+		checkRef(t, ref, "info Start\ndone", 0)
+		checkRef(t, ref, "info Start\nDone", 2)
+	})
+	t.Run("line", func(t *testing.T) {
+		const ref = "> INFO start\n %\n> done"
+		checkRef(t, ref, "Info START\ndone", 0)
+		checkRef(t, ref, "Info START\nDONE", 2)
+	})
+	t.Run("mask", func(t *testing.T) {
+		const ref = "> id=abcd lvl=INFO\n .   hhhh     llll\n ?h [0-9a-f]\n ~l INFO\n %hl"
+		checkRef(t, ref, "id=ABcd lvl=info", 0)
+		checkRef(t, ref, "ID=abcd lvl=info", 2)
+	})
+	t.Run("prepare", func(t *testing.T) {
+		var ref strings.Builder
+		prep := Prepare{FoldCase: true}
+		testerr.Shall(prep.Text(&ref, strings.NewReader("Hello World"))).BeNil(t)
+		checkRef(t, ref.String(), "HELLO WORLD", 0)
+	})
+}
+
+func TestTexst_forbidden(t *testing.T) {
+	check := func(t *testing.T, ref, subj string, mm int) (violations []string) {
+		t.Helper()
+		checkWith(t, Texst{OnForbidden: func(n int, _ []byte, fl *RefLine) {
+			violations = append(violations, fmt.Sprintf("%d:%d", n, fl.SourceLine()))
+		}}, ref, subj, mm)
+		return violations
+	}
+	t.Run("preamble", func(t *testing.T) {
+		const ref = "! panic:\n! ERROR\n> a\n> b\nskip *"
+		check(t, ref, "a\nb", 0)
+		vs := check(t, ref, "a\nb\nfoo: panic: x\nlast ERROR", 2)
+		if !slices.Equal(vs, []string{"3:1", "4:2"}) {
+			t.Error("violations", vs)
+		}
+		vs = check(t, ref, "a ERROR", 3)
+		if !slices.Equal(vs, []string{"1:2"}) {
+			t.Error("violations", vs)
+		}
+	})
+	t.Run("block", func(t *testing.T) {
+		const ref = "> start\n(\n! warn n\n .     n\n ?n [0-9]\n> x\nskip\n> y\n)\n> end\n> warn 1"
+		check(t, ref, "start\nx\nwarn\ny\nend\nwarn 1", 0)
+		vs := check(t, ref, "start\nx\nwarn 7\ny\nend\nwarn 1", 1)
+		if !slices.Equal(vs, []string{"3:3"}) {
+			t.Error("violations", vs)
+		}
+	})
+	t.Run("not in body", func(t *testing.T) {
+		rd := testerr.Shall1(NewRefString(t.Name(), "> a\n! b")).BeNil(t)
+		testerr.Shall1(rd.NextLine()).BeNil(t)
+		if _, err := rd.NextLine(); err == nil {
+			t.Error("forbidden line in body")
+		}
+	})
+	t.Run("undeclared group", func(t *testing.T) {
+		_, err := NewRefString(t.Name(), "%%12\n!3 panic\n>1 a")
+		if err == nil || err.Error() != t.Name()+":2:undeclared interleaving group '3'" {
+			t.Error("preamble:", err)
+		}
+		rd := testerr.Shall1(NewRefString(t.Name(), "%%12\n(3\n!3 warn\n>3 a\n)")).BeNil(t)
+		_, err = rd.NextLine()
+		if err == nil || err.Error() != t.Name()+":3:undeclared interleaving group '3'" {
+			t.Error("block:", err)
+		}
+	})
+}
+
+func TestTexst_filter(t *testing.T) {
+	const ref = "@filter ^DEBUG \n@filter ^$\n! panic\n> start\n> end"
+	check := func(t *testing.T, subj string, mm int) (drops []string) {
+		t.Helper()
+		checkWith(t, Texst{OnFilter: func(f *Filter, n int) {
+			drops = append(drops, fmt.Sprintf("%d:%d", f.SourceLine(), n))
+		}}, ref, subj, mm)
+		return drops
+	}
+	if ds := check(t, "start\nend", 0); !slices.Equal(ds, []string{"1:0", "2:0"}) {
+		t.Error("drops", ds)
+	}
+	ds := check(t, "DEBUG x\nstart\n\nDEBUG y\n\nend", 0)
+	if !slices.Equal(ds, []string{"1:2", "2:2"}) {
+		t.Error("drops", ds)
+	}
+	check(t, "start\nDEBUG panic\nend", 1)
+	t.Run("body", func(t *testing.T) {
+		rd := testerr.Shall1(NewRefString(t.Name(), "> a\n@filter x\n> b")).BeNil(t)
+		if _, err := rd.NextLine(); err == nil {
+			t.Error("filter in body")
+		}
+	})
+}
+
+func TestTexst_rewrite(t *testing.T) {
+	t.Setenv("TEXST_TEST_DIR", "/tmp/x1")
+	const ref = `@replace /id=[0-9]+/id=N/
+@replace |(\w+)@(\w+)|$2:$1|
+@paths
+@env TEXST_TEST_DIR TEXST_TEST_UNSET
+> id=N file $TEXST_TEST_DIR/a/b
+> host:user`
+	refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	var rws, matched []string
+	txs := Texst{
+		OnRewrite: func(n int, orig, rw []byte) {
+			rws = append(rws, fmt.Sprintf("%d %s", n, rw))
+		},
+		OnMatch: func(n int, l, rw []byte, _ *RefLine, _ []int) {
+			matched = append(matched, fmt.Sprintf("%s -> %s", l, rw))
+		},
+	}
+	subj := "id=4711 file /tmp/x1\\a\\b\nuser@host"
+	mmn := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+	if mmn != 0 {
+		t.Errorf("%d mismatches", mmn)
+	}
+	if !slices.Equal(rws, []string{"1 id=N file $TEXST_TEST_DIR/a/b", "2 host:user"}) {
+		t.Error("rewrites", rws)
+	}
+	if !slices.Equal(matched, []string{
+		`id=4711 file /tmp/x1\a\b -> id=N file $TEXST_TEST_DIR/a/b`,
+		"user@host -> host:user",
+	}) {
+		t.Error("matched", matched)
+	}
+	t.Run("match indices", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), `@replace /a/aaaaaaaa/
+> aaaaaaaa xx
+ .         mm`)).BeNil(t)
+		var mask string
+		txs := Texst{OnMatch: func(_ int, _, rw []byte, _ *RefLine, m []int) {
+			mask = string(rw[m[2]:m[3]])
+		}}
+		mmn := testerr.Shall1(txs.Check(refRd, strings.NewReader("a xx"))).BeNil(t)
+		if mmn != 0 || mask != "xx" {
+			t.Errorf("%d mismatches, mask '%s'", mmn, mask)
+		}
+	})
+	t.Run("env order", func(t *testing.T) {
+		t.Setenv("TEXST_TEST_HOME", "/tmp/h")
+		t.Setenv("TEXST_TEST_TMP", "/tmp/h/tmp")
+		refRd := testerr.Shall1(NewRefString(t.Name(),
+			"@env TEXST_TEST_HOME TEXST_TEST_TMP\n> $TEXST_TEST_TMP/x $TEXST_TEST_HOME/y",
+		)).BeNil(t)
+		mmn := testerr.Shall1((&Texst{}).Check(refRd, strings.NewReader("/tmp/h/tmp/x /tmp/h/y"))).BeNil(t)
+		if mmn != 0 {
+			t.Errorf("%d mismatches", mmn)
+		}
+	})
+	for _, arg := range []string{"", "/x/", "/x/y/z/", "/(/x/"} {
+		if _, _, err := parseReplace(arg); err == nil {
+			t.Errorf("no error for replace '%s'", arg)
+		}
+	}
+}
+
+func TestTexst_vars(t *testing.T) {
+	vars := map[string]string{"DIR": "/tmp/a.b", "X": ""}
+	check := func(t *testing.T, ref, subj string, mm int) {
+		t.Helper()
+		checkWith(t, Texst{}, ref, subj, mm, WithVars(vars))
+	}
+	const ref = "> ${DIR}/f${X}.txt id=00\n .                    ii"
+	check(t, ref, "/tmp/a.b/f.txt id=42", 0)
+	check(t, ref, "/tmp/axb/f.txt id=42", 2)
+	for _, ref := range []string{
+		"> ${NOPE}",
+		"> ${DIR}x\n .  x",
+	} {
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref, WithVars(vars))).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Errorf("no error for '%s'", ref)
+		}
+	}
+	t.Run("no vars", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "> ${DIR}")).BeNil(t)
+		mmn := testerr.Shall1(new(Texst).Check(refRd, strings.NewReader("${DIR}"))).BeNil(t)
+		if mmn != 0 {
+			t.Errorf("%d mismatches", mmn)
+		}
+	})
+	t.Run("prepare", func(t *testing.T) {
+		var ref strings.Builder
+		prep := Prepare{Vars: vars}
+		testerr.Shall(prep.Text(&ref, strings.NewReader("in /tmp/a.b/f"))).BeNil(t)
+		if s := ref.String(); s != "> in ${DIR}/f" {
+			t.Errorf("prepared '%s'", s)
+		}
+	})
+}
+
+func TestTexst_continuation(t *testing.T) {
+	check := func(t *testing.T, ref, subj string, mm int) (mism []int) {
+		t.Helper()
+		checkWith(t, Texst{OnMismatch: func(n int, _ []byte, _ []*RefLine) {
+			mism = append(mism, n)
+		}}, ref, subj, mm)
+		return mism
+	}
+	const ref = `%%12
+@continue ^\s
+>1panic: boom
++1	at main.go:00
+ .            nn
+>2other
+>1done`
+	check(t, ref, "panic: boom\n\tat main.go:12\nother\ndone", 0)
+	check(t, ref, "other\npanic: boom\n\tat main.go:12\ndone", 0)
+	mm := check(t, ref, "panic: boom\nother\n\tat main.go:12\ndone", 4)
+	if !slices.Equal(mm, []int{1, 2, 4, 5}) {
+		t.Error("mismatches in lines", mm)
+	}
+	t.Run("no directive", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "> a\n+ b")).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Error("continuation without directive")
+		}
+	})
+}
+
+func TestTexst_encoding(t *testing.T) {
+	t.Run("latin1", func(t *testing.T) {
+		const ref = "@encoding iso-8859-1\n> Grüße\n> 3 °C"
+		checkWith(t, Texst{}, ref, "Gr\xfc\xdfe\n3 \xb0C", 0)
+		checkWith(t, Texst{}, ref, "Grüße\n3 °C", 3)
+	})
+	t.Run("windows-1252", func(t *testing.T) {
+		checkWith(t, Texst{}, "@encoding cp1252\n> 5 € – ok", "5 \x80 \x96 ok", 0)
+	})
+	t.Run("utf-16", func(t *testing.T) {
+		const ref = "@encoding utf-16\n> a€\n> 😀b"
+		checkWith(t, Texst{}, ref, "\xfe\xff\x00a\x20\xac\x00\n\xd8\x3d\xde\x00\x00b", 0)
+		checkWith(t, Texst{}, ref, "\xff\xfea\x00\xac\x20\n\x00\x3d\xd8\x00\xdeb\x00", 0)
+		checkWith(t, Texst{Encoding: "utf-16le"}, "> a€", "a\x00\xac\x20", 0)
+	})
+	t.Run("bytes", func(t *testing.T) {
+		const ref = "@encoding bytes\n> ä \\xff\\x00\\\\ xx\n .             ..\n> \\xc3\\xa4"
+		checkWith(t, Texst{}, ref, "ä \xff\x00\\ \x01\x02\nä", 0)
+		checkWith(t, Texst{}, ref, "ä \xfe\x00\\ \x01\x02\n\xe4", 3)
+		refRd := testerr.Shall1(NewRefString(t.Name(), "@encoding bytes\n> \\xf")).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Error("incomplete escape sequence")
+		}
+		refRd = testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		txs := Texst{Encoding: EncLatin1}
+		if _, err := txs.Check(refRd, strings.NewReader("")); err == nil {
+			t.Error("override byte-exact mode")
+		}
+	})
+}
+
+func TestTexst_lineLength(t *testing.T) {
+	long := strings.Repeat("x", 100_000)
+	t.Run("unlimited", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "> a\n> "+long+"\n> b")).BeNil(t)
+		var txs Texst
+		mm := testerr.Shall1(txs.Check(refRd, strings.NewReader("a\n"+long+"\nb"))).BeNil(t)
+		if mm != 0 {
+			t.Errorf("%d mismatches", mm)
+		}
+	})
+	t.Run("subject limit", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "> a\n> b")).BeNil(t)
+		var mism []int
+		var reason error
+		txs := Texst{
+			MaxLineLen: 1000,
+			OnMismatch: func(n int, l []byte, _ []*RefLine) {
+				mism = append(mism, n)
+				if len(l) > 1000 {
+					t.Errorf("line of length %d not truncated", len(l))
+				}
+			},
+			OnReason: func(_ int, r error) { reason = r },
+		}
+		mm := testerr.Shall1(txs.Check(refRd, strings.NewReader("a\n"+long+"\r\nb"))).BeNil(t)
+		if mm != 1 || !slices.Equal(mism, []int{2}) {
+			t.Errorf("%d mismatches in lines %v", mm, mism)
+		}
+		var lerr *LineLengthError
+		if !errors.As(reason, &lerr) || lerr.Max != 1000 {
+			t.Errorf("unexpected reason %v", reason)
+		}
+	})
+	t.Run("reference limit", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "> a\n> "+long,
+			WithMaxLineLen(1000),
+		)).BeNil(t)
+		_, err := refRd.NextLine()
+		if err == nil || !strings.Contains(err.Error(), ":2:line exceeds") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestTexst_search(t *testing.T) {
+	check := func(t *testing.T, budget int, ref, subj string, mm int) (reasons []error) {
+		t.Helper()
+		checkWith(t, Texst{
+			SearchBudget: budget,
+			OnReason:     func(_ int, r error) { reasons = append(reasons, r) },
+		}, ref, subj, mm)
+		return reasons
+	}
+	const ref = `%%ab
+>aitem x
+ .     x
+>aend
+>bitem 1`
+	const subj = "item 1\nitem 2\nend"
+	check(t, 0, ref, subj, 2)
+	check(t, 10, ref, subj, 0)
+	check(t, 10, ref, "item 2\nitem 1\nend", 0)
+	check(t, 10, ref, "item 1\nitem 1\nend\nfoo", 1)
+	t.Run("budget", func(t *testing.T) {
+		const ref = `%%ab
+>ax
+ {0,}
+>bx
+ {0,}`
+		subj := strings.Repeat("x\n", 20) + "y"
+		reasons := check(t, 10, ref, subj, 2)
+		var aerr *AmbiguousError
+		if len(reasons) == 0 || !errors.As(reasons[0], &aerr) || len(aerr.Refs) != 2 {
+			t.Errorf("unexpected reasons %v", reasons)
+		}
+	})
+	t.Run("report once", func(t *testing.T) {
+		for _, test := range []struct {
+			ref, subj string
+			budget    int
+			mm        int
+		}{
+			{"%%ab\n>ax\n>ay\n>bx\n>bz", "x\nz\nx\ny\nQ", 10, 1},
+			{"%%ab\n>ax\n {0,}\n>bx\n {0,}", strings.Repeat("x\n", 20) + "y", 10, 2},
+		} {
+			refRd := testerr.Shall1(NewRefString(t.Name(), test.ref)).BeNil(t)
+			var reported []int
+			txs := Texst{
+				SearchBudget: test.budget,
+				OnMatch:      func(n int, _, _ []byte, _ *RefLine, _ []int) { reported = append(reported, n) },
+				OnMismatch:   func(n int, _ []byte, _ []*RefLine) { reported = append(reported, n) },
+			}
+			mmn := testerr.Shall1(txs.Check(refRd, strings.NewReader(test.subj))).BeNil(t)
+			if mmn != test.mm {
+				t.Errorf("%q: %d mismatches", test.subj, mmn)
+			}
+			for i, n := range reported {
+				if n != i+1 {
+					t.Errorf("%q: reported lines %v", test.subj, reported)
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestTexst_instances(t *testing.T) {
+	check := func(t *testing.T, ref, subj string, mm int) (reasons []error) {
+		t.Helper()
+		checkWith(t, Texst{OnReason: func(_ int, r error) { reasons = append(reasons, r) }}, ref, subj, mm)
+		return reasons
+	}
+	const ref = `%% w
+@instances w k 1..2
+> main start
+>wworker 0 start
+ .       k
+>wworker 0 done
+ .       k
+> main end`
+	check(t, ref, "main start\nworker 1 start\nworker 1 done\nmain end", 0)
+	check(t, ref, "main start\nworker 1 start\nworker 2 start\nworker 2 done\nworker 1 done\nmain end", 0)
+	check(t, ref, "main start\nworker 1 start\nworker 1 start\nworker 1 done\nmain end", 1)
+	check(t, ref, "main start\nworker 1 start\nworker 2 start\nworker 2 done\nmain end", 1)
+	reasons := check(t, ref, "main start\nmain end", 1)
+	var ierr *InstanceError
+	if len(reasons) != 1 || !errors.As(reasons[0], &ierr) || ierr.Count != 0 {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+	reasons = check(t, ref, "main start\nworker 1 start\nworker 2 start\nworker 3 start\n"+
+		"worker 2 done\nworker 1 done\nmain end", 1)
+	if len(reasons) != 1 || !errors.As(reasons[0], &ierr) || ierr.Key != "3" {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+	t.Run("no key mask", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "%%w\n@instances w k\n>wstart")).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Error("template line without key mask")
+		}
+	})
+	t.Run("after groups", func(t *testing.T) {
+		const ref = "%% w\n@instances w k\n>wm 0 start\n .m k\n ~m (a|b)\n>w0 done\n .k"
+		check(t, ref, "a 1 start\nb 2 start\n2 done\n1 done", 0)
+	})
+}
+
+func TestTexst_namedIGroups(t *testing.T) {
+	const ref = `%%1{db,http}
+@instances {http} r
+>{db}connect
+>{http}GET /x
+ .          r
+>1start
+skip{db} *
+>{db}close`
+	refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	var mism []string
+	txs := Texst{OnMismatch: func(_ int, _ []byte, ref []*RefLine) {
+		for _, rl := range ref {
+			mism = append(mism, rl.IGroupName())
+		}
+	}}
+	subj := "connect\nGET /a\nstart\nquery\nGET /b\nclose"
+	mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+	if mm != 0 {
+		t.Errorf("%d mismatches", mm)
+	}
+	refRd = testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	mm = testerr.Shall1(txs.Check(refRd, strings.NewReader("start"))).BeNil(t)
+	if mm != 1 || !slices.Equal(mism, []string{"db"}) {
+		t.Errorf("%d mismatches of groups %v", mm, mism)
+	}
+	t.Run("undeclared", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "%%{db}\n>{web}x")).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Error("undeclared named group")
+		}
+	})
+	t.Run("redefined", func(t *testing.T) {
+		for _, decl := range []string{"%%aa", "%%a{a}", "%%{a}a", "%%{db,db}"} {
+			if _, err := NewRefString(t.Name(), decl+"\n>ax"); err == nil {
+				t.Errorf("no error for %q", decl)
+			}
+		}
+	})
+	t.Run("mask columns", func(t *testing.T) {
+		const ref = `%%{http}
+*tmpl.      t
+@masks {http} tmpl
+>{http}GET /index.html
+ .         m`
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		rl := testerr.Shall1(refRd.NextLine()).BeNil(t)
+		if ms := rl.Masks(); len(ms) != 2 || ms[0].String() != "[m:4+1]" || ms[1].String() != "[t:6+1]" {
+			t.Error("masks", ms)
+		}
+		refRd = testerr.Shall1(NewRefString(t.Name(), "%%{http}\n>{http}GET /\n .  m")).BeNil(t)
+		if _, err := refRd.NextLine(); err == nil {
+			t.Error("mask in front of reference text")
+		}
+	})
+}
+
+func TestTexst_sync(t *testing.T) {
+	const ref = `%%12
+@barrier done 12
+>1start
+>2work
+ :w
+|1 done
+|2 done
+>1shutdown
+>2exit
+ >w`
+	var reasons []error
+	txs := Texst{OnReason: func(_ int, reason error) { reasons = append(reasons, reason) }}
+	refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+	subj := "start\nwork\nshutdown\nexit"
+	mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+	if mm != 0 {
+		t.Errorf("%d mismatches", mm)
+	}
+	t.Run("barrier", func(t *testing.T) {
+		reasons = nil
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		subj := "start\nshutdown\nwork\nexit"
+		mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+		if mm != 2 {
+			t.Errorf("%d mismatches", mm)
+		}
+		var be *BarrierError
+		if len(reasons) == 0 || !errors.As(reasons[0], &be) {
+			t.Fatalf("reasons %v", reasons)
+		}
+		if be.Ref.Text() != "shutdown" || !slices.Equal(be.Waiting, []string{"2"}) {
+			t.Errorf("barrier error: %s", be)
+		}
+	})
+	t.Run("released", func(t *testing.T) {
+		const ref = "%%mw\n@barrier done mw\n>mstart\n>wwork\n?wcleanup\n|w done\n|m done\n>mshutdown"
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		subj := "start\nwork\nshutdown\ncleanup"
+		mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(subj))).BeNil(t)
+		if mm != 1 {
+			t.Errorf("%d mismatches", mm)
+		}
+	})
+	t.Run("optional", func(t *testing.T) {
+		const ref = "%%mw\n@barrier done mw\n@group w optional\n>mstart\n>wwork\n|w done\n|m done\n>mshutdown\n>wexit"
+		for _, test := range []struct {
+			subj string
+			mm   int
+		}{
+			{"start\nshutdown", 0},
+			{"start\nwork\nshutdown\nexit", 0},
+			{"start\nshutdown\nexit", 1},
+			{"start\nshutdown\nwork\nexit", 1},
+		} {
+			refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+			mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(test.subj))).BeNil(t)
+			if mm != test.mm {
+				t.Errorf("%q: %d mismatches, expected %d", test.subj, mm, test.mm)
+			}
+		}
+	})
+	t.Run("happens-before", func(t *testing.T) {
+		reasons = nil
+		const ref = "%%12\n>1ready\n :r\n>2go\n >r"
+		refRd := testerr.Shall1(NewRefString(t.Name(), ref)).BeNil(t)
+		mm := testerr.Shall1(txs.Check(refRd, strings.NewReader("go\nready"))).BeNil(t)
+		if mm != 2 {
+			t.Errorf("%d mismatches", mm)
+		}
+		var oe *OrderError
+		if len(reasons) == 0 || !errors.As(reasons[0], &oe) || oe.Label != "r" {
+			t.Errorf("reasons %v", reasons)
+		}
+	})
+	t.Run("errors", func(t *testing.T) {
+		for _, ref := range []string{
+			"%%12\n@barrier done 13\n>1x",
+			"%%12\n@barrier done 1\n>1x",
+			"%%12\n@barrier done 12\n|1 other",
+			"%%123\n@barrier done 12\n|3 done",
+			"%%12\n@barrier done 12\n|1 done\n|1 done",
+			"%%12\n@barrier done 12\n(1\n|1 done\n)",
+			"%%12\n>1x\n :a\n>2y\n :a",
+			"%%12\n>1x\n :a\n>2y\n >b",
+		} {
+			refRd, err := NewRefString(t.Name(), ref)
+			for err == nil {
+				_, err = refRd.NextLine()
+			}
+			if errors.Is(err, io.EOF) {
+				t.Errorf("no error for reference %q", ref)
+			}
+		}
+	})
+	t.Run("undefined label", func(t *testing.T) {
+		refRd := testerr.Shall1(NewRefString(t.Name(), "%%12\n>2y\n >a b\n>1x\n :a")).BeNil(t)
+		var err error
+		for err == nil {
+			_, err = refRd.NextLine()
+		}
+		if err.Error() != t.Name()+":3:undefined label 'b'" {
+			t.Error(err)
+		}
+	})
+}
+
+func TestTexst_groupPolicy(t *testing.T) {
+	const ref = ">mstart\n>wwork\n>wdone\n>mend"
+	for _, test := range []struct {
+		policy string
+		subj   string
+		mm     int
+	}{
+		{"strict", "start\nwork\ndone\nend", 0},
+		{"strict", "start\nend", 1},
+		{"optional", "start\nend", 0},
+		{"optional", "start\nwork\nend", 1},
+		{"truncate", "start\nwork\nend", 0},
+		{"truncate", "start\nend", 1},
+		{"optional,truncate", "start\nend", 0},
+		{"optional truncate", "start\nwork\nend", 0},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			refRd := testerr.Shall1(NewRefString(t.Name(), "%%mw\n@group w "+test.policy+"\n"+ref)).BeNil(t)
+			var txs Texst
+			mm := testerr.Shall1(txs.Check(refRd, strings.NewReader(test.subj))).BeNil(t)
+			if mm != test.mm {
+				t.Errorf("%q: %d mismatches, expected %d", test.subj, mm, test.mm)
+			}
+		})
+	}
+	t.Run("errors", func(t *testing.T) {
+		for _, ref := range []string{
+			"%%mw\n@group x optional\n>mx",
+			"%%mw\n@group w sometimes\n>mx",
+			"%%mw\n@group w\n>mx",
+			"%%mw\n@group w optional\n@group w truncate\n>mx",
+			"%%mw\n>mx\n@group w optional",
+		} {
+			refRd, err := NewRefString(t.Name(), ref)
+			for err == nil {
+				_, err = refRd.NextLine()
+			}
+			if errors.Is(err, io.EOF) {
+				t.Errorf("no error for reference %q", ref)
+			}
+		}
+	})
+}
@@ -101,6 +101,12 @@ type Config struct {
 	MismatchLimit   int
 	RecordOverwrite bool
 	KeepSubject     bool
+	// SearchBudget enables the search for an assignment of subject lines to
+	// interleaving groups, see texst.Texst.SearchBudget.
+	SearchBudget int
+	// Vars are the values of the placeholders ${NAME} in the reference text,
+	// see texst.WithVars. Recording replaces the values with placeholders.
+	Vars map[string]string
 }
 
 var defaultConfig = Config{
@@ -110,6 +116,16 @@ var defaultConfig = Config{
 	KeepSubject:     true,
 }
 
+// WithVars returns the default configuration with the values vars for the
+// placeholders ${NAME} in the reference text, e.g.
+//
+//	texsting.WithVars(map[string]string{"DIR": t.TempDir()}).Error(t, "", subj)
+func WithVars(vars map[string]string) Config {
+	cfg := defaultConfig
+	cfg.Vars = vars
+	return cfg
+}
+
 func (cfg Config) Error(t *testing.T, hint string, subj io.Reader) error {
 	if opts := recodTest(t); opts != nil {
 		tcfg := cfg
@@ -185,7 +201,13 @@ func recodTest(t *testing.T) *recordOpts {
 }
 
 func (cfg *Config) compare(t *testing.T, hint string, subj io.Reader) (misNo int, err error) {
-	cmpr := &texst.Texst{OnMismatch: MismatchError(t, hint)}
+	cmpr := &texst.Texst{
+		OnMismatch:   MismatchError(t, hint),
+		OnReason:     ReasonError(t, hint),
+		OnForbidden:  ForbiddenError(t, hint),
+		OnFilter:     FilterLog(t, hint),
+		SearchBudget: cfg.SearchBudget,
+	}
 	if testing.Verbose() {
 		cmpr.OnMatch = MatchLog(t, hint)
 	}
@@ -197,7 +219,11 @@ func (cfg *Config) compare(t *testing.T, hint string, subj io.Reader) (misNo int
 		)
 		return 0, fmt.Errorf("reference texst file %s does not exists", reffile)
 	}
-	ref, err := texst.OpenRefFile(reffile)
+	var opts []texst.RefOption
+	if cfg.Vars != nil {
+		opts = append(opts, texst.WithVars(cfg.Vars))
+	}
+	ref, err := texst.OpenRefFile(reffile, opts...)
 	if err != nil {
 		return 0, err
 	}
@@ -240,7 +266,7 @@ func (cfg Config) Record(t *testing.T, hint string, subj io.Reader) {
 		t.Fatal(err)
 	}
 	defer wr.Close()
-	if err = (texst.Prepare{}).Text(wr, subj); err != nil {
+	if err = (texst.Prepare{Vars: cfg.Vars}).Text(wr, subj); err != nil {
 		t.Error(err)
 	}
 	t.Errorf("texst test-recorder wrote: %s", reffile)
@@ -254,10 +280,10 @@ func MismatchError(t *testing.T, hint string) texst.MismatchFunc {
 		var sb strings.Builder
 		fmt.Fprintf(&sb, "mismatch %s:%d [%s]", hint, n, string(l))
 		for _, r := range ref {
-			fmt.Fprintf(&sb, "\n%s:%d>%c[%s]",
+			fmt.Fprintf(&sb, "\n%s:%d>%s[%s]",
 				r.SourceName(),
 				r.SourceLine(),
-				r.IGroup(),
+				r.IGroupName(),
 				r.Text(),
 			)
 		}
@@ -265,11 +291,49 @@ func MismatchError(t *testing.T, hint string) texst.MismatchFunc {
 	}
 }
 
+func ReasonError(t *testing.T, hint string) texst.ReasonFunc {
+	if hint == "" {
+		hint = t.Name()
+	}
+	return func(n int, reason error) {
+		t.Errorf("mismatch reason %s:%d: %s", hint, n, reason)
+	}
+}
+
+func ForbiddenError(t *testing.T, hint string) texst.ForbiddenFunc {
+	if hint == "" {
+		hint = t.Name()
+	}
+	return func(n int, l []byte, fl *texst.RefLine) {
+		t.Errorf("forbidden %s:%d [%s]\n%s:%d!%s[%s]",
+			hint, n, string(l),
+			fl.SourceName(),
+			fl.SourceLine(),
+			fl.IGroupName(),
+			fl.Text(),
+		)
+	}
+}
+
+func FilterLog(t *testing.T, hint string) texst.FilterFunc {
+	if hint == "" {
+		hint = t.Name()
+	}
+	return func(f *texst.Filter, dropped int) {
+		t.Logf("filter %s:%d dropped %d lines of %s",
+			f.SourceName(),
+			f.SourceLine(),
+			dropped,
+			hint,
+		)
+	}
+}
+
 func MatchLog(t *testing.T, hint string) texst.MatchFunc {
 	if hint == "" {
 		hint = t.Name()
 	}
-	return func(n int, l []byte, ref *texst.RefLine, match []int) {
+	return func(n int, l, _ []byte, ref *texst.RefLine, match []int) {
 		if hint == "" {
 			hint = ref.SourceName()
 		}
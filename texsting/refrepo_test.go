@@ -25,3 +25,10 @@ func TestError(t *testing.T) {
 	defer resp.Body.Close()
 	Error(t, "", resp.Body)
 }
+
+func TestWithVars(t *testing.T) {
+	dir := t.TempDir()
+	WithVars(map[string]string{"DIR": dir}).FatalString(t, "",
+		"write "+dir+"/out.txt\ndone",
+	)
+}
@@ -0,0 +1,238 @@
+package texst
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the names of the Go time layouts that can be used instead
+// of the layout itself.
+var timeLayouts = map[string]string{
+	"Layout":      time.Layout,
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+	"StampMicro":  time.StampMicro,
+	"StampNano":   time.StampNano,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+}
+
+func timeLayout(s string) string {
+	if l, ok := timeLayouts[s]; ok {
+		return l
+	}
+	return s
+}
+
+// TimeOrder is the order that the values of a timestamp mask must have in
+// the subject text.
+type TimeOrder int8
+
+const (
+	// Timestamps are non-decreasing across the whole subject.
+	OrderSubject TimeOrder = iota
+	// Timestamps are non-decreasing within each interleaving group.
+	OrderIGroup
+	// Timestamps need not be ordered.
+	OrderNone
+)
+
+var timeOrderNames = []string{"subject", "igroup", "none"}
+
+func (o TimeOrder) String() string {
+	if o < 0 || int(o) >= len(timeOrderNames) {
+		return fmt.Sprintf("TimeOrder(%d)", o)
+	}
+	return timeOrderNames[o]
+}
+
+// timeSpec declares a mask to be a timestamp.
+type timeSpec struct {
+	layout string
+	order  TimeOrder
+}
+
+// parseTimeSpec parses "[order] layout" where layout is a Go time layout or
+// the name of a layout constant from package time, e.g. "StampMilli".
+func parseTimeSpec(s string) (*timeSpec, error) {
+	ts := &timeSpec{order: OrderSubject}
+	if w, rest, _ := strings.Cut(s, " "); w != "" {
+		for i, n := range timeOrderNames {
+			if w == n {
+				ts.order = TimeOrder(i)
+				s = strings.TrimSpace(rest)
+				break
+			}
+		}
+	}
+	if s == "" {
+		return nil, fmt.Errorf("missing time layout")
+	}
+	ts.layout = timeLayout(s)
+	return ts, nil
+}
+
+// timeMark records the time of the mask named mask under the name label when
+// its reference line matches.
+type timeMark struct {
+	mask  rune
+	label string
+}
+
+// timeGap bounds the duration from the time mark label to the time of the
+// mask named mask.
+type timeGap struct {
+	mask   rune
+	label  string
+	lo, hi *time.Duration
+}
+
+// parseTimeGap parses "label range" where range is "D", which is the same
+// as "0..D", or a range "lo..hi" with optional bounds.
+func parseTimeGap(mask rune, s string) (timeGap, error) {
+	label, rng, _ := strings.Cut(s, " ")
+	if label == "" {
+		return timeGap{}, fmt.Errorf("missing time mark")
+	}
+	rng = strings.TrimSpace(rng)
+	if rng == "" {
+		return timeGap{}, fmt.Errorf("missing range of time gap")
+	}
+	if !strings.Contains(rng, "..") {
+		rng = "0s.." + rng
+	}
+	lo, hi, err := parseBounds(rng, time.ParseDuration)
+	if err != nil {
+		return timeGap{}, err
+	}
+	return timeGap{mask: mask, label: label, lo: lo, hi: hi}, nil
+}
+
+// clocks track the timestamps of the matched subject lines.
+type clocks struct {
+	last  map[clockKey]stamp // For each timestamp mask and order scope
+	marks map[string]stamp
+}
+
+type clockKey struct {
+	mask   rune
+	igroup rune // 0 for OrderSubject
+}
+
+type stamp struct {
+	time time.Time
+	line int
+}
+
+func newClocks() clocks {
+	return clocks{
+		last:  make(map[clockKey]stamp),
+		marks: make(map[string]stamp),
+	}
+}
+
+func scopeKey(rl *RefLine, m *Mask) clockKey {
+	if m.time.order == OrderIGroup {
+		return clockKey{mask: m.name, igroup: rl.igName}
+	}
+	return clockKey{mask: m.name}
+}
+
+// check returns a *CheckError if a timestamp of rl cannot be parsed, if it
+// is before the last timestamp in its scope or if it violates a time gap of
+// rl.
+func (cs clocks) check(rl *RefLine, line []byte, match []int) error {
+	for i, m := range rl.masks {
+		if m.time == nil {
+			continue
+		}
+		txt := rl.segment(line, match, i)
+		t, err := time.Parse(m.time.layout, string(txt))
+		if err != nil {
+			return &CheckError{
+				Ref:  rl,
+				Mask: m,
+				Text: string(txt),
+				Err:  fmt.Errorf("not a time '%s': %s", m.time.layout, txt),
+			}
+		}
+		if m.time.order != OrderNone {
+			if last, ok := cs.last[scopeKey(rl, m)]; ok && t.Before(last.time) {
+				return &CheckError{
+					Ref:  rl,
+					Mask: m,
+					Text: string(txt),
+					Err: fmt.Errorf("time %s before %s in line %d",
+						txt,
+						last.time.Format(m.time.layout),
+						last.line,
+					),
+				}
+			}
+		}
+		for _, gap := range rl.gaps {
+			if gap.mask != m.name {
+				continue
+			}
+			mark, ok := cs.marks[gap.label]
+			if !ok {
+				return &CheckError{
+					Ref:  rl,
+					Mask: m,
+					Text: string(txt),
+					Err:  fmt.Errorf("time mark '%s' not set", gap.label),
+				}
+			}
+			if err := checkBounds(t.Sub(mark.time), gap.lo, gap.hi, time.Duration.String); err != nil {
+				return &CheckError{
+					Ref:  rl,
+					Mask: m,
+					Text: string(txt),
+					Err: fmt.Errorf("gap to time mark '%s' in line %d: %w",
+						gap.label,
+						mark.line,
+						err,
+					),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bind records the timestamps and time marks of the matched line rl. The
+// timestamps must have passed check. Timestamps that cannot be parsed are
+// not recorded.
+func (cs clocks) bind(rl *RefLine, lno int, line []byte, match []int) {
+	for i, m := range rl.masks {
+		if m.time == nil {
+			continue
+		}
+		t, err := time.Parse(m.time.layout, string(rl.segment(line, match, i)))
+		if err != nil {
+			continue
+		}
+		s := stamp{time: t, line: lno}
+		if m.time.order != OrderNone {
+			cs.last[scopeKey(rl, m)] = s
+		}
+		for _, mark := range rl.marks {
+			if mark.mask == m.name {
+				cs.marks[mark.label] = s
+			}
+		}
+	}
+}